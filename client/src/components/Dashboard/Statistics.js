@@ -17,10 +17,11 @@ class Statistics extends Component {
             replacedParental,
         } = this.props;
 
-        const filteringData = [this.props.history[1]];
-        const queriesData = [this.props.history[2]];
-        const parentalData = [this.props.history[3]];
-        const safebrowsingData = [this.props.history[4]];
+        const getSeries = key => [this.props.history.find(item => item.key === key)];
+        const filteringData = getSeries('blocked_filtering');
+        const queriesData = getSeries('dns_queries');
+        const parentalData = getSeries('replaced_parental');
+        const safebrowsingData = getSeries('replaced_safebrowsing');
 
         return (
             <div className="row">
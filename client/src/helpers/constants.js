@@ -7,6 +7,9 @@ export const R_MAC = /^((([a-fA-F0-9][a-fA-F0-9]+[-]){5}|([a-fA-F0-9][a-fA-F0-9]
 export const STATS_NAMES = {
     avg_processing_time: 'average_processing_time',
     blocked_filtering: 'Blocked by filters',
+    blocked_percentage: 'Blocked, %',
+    cache_hits: 'Cache hits',
+    cache_misses: 'Cache misses',
     dns_queries: 'DNS queries',
     replaced_parental: 'stats_adult',
     replaced_safebrowsing: 'stats_malware_phishing',
@@ -47,29 +47,34 @@ export const normalizeLogs = logs => logs.map((log) => {
     };
 });
 
-export const normalizeHistory = history => Object.keys(history).map((key) => {
-    let id = STATS_NAMES[key];
-    if (!id) {
-        id = key.replace(/_/g, ' ').replace(/^\w/, c => c.toUpperCase());
-    }
-
+export const normalizeHistory = (history) => {
+    const { time_labels: timeLabels, ...series } = history;
     const dayAgo = subHours(Date.now(), 24);
 
-    const data = history[key].map((item, index) => {
-        const formatHour = dateFormat(addHours(dayAgo, index), 'ddd HH:00');
-        const roundValue = round(item, 2);
+    return Object.keys(series).map((key) => {
+        let id = STATS_NAMES[key];
+        if (!id) {
+            id = key.replace(/_/g, ' ').replace(/^\w/, c => c.toUpperCase());
+        }
+
+        const data = series[key].map((item, index) => {
+            const time = timeLabels ? timeLabels[index] : addHours(dayAgo, index);
+            const formatHour = dateFormat(time, 'ddd HH:00');
+            const roundValue = round(item, 2);
+
+            return {
+                x: formatHour,
+                y: roundValue,
+            };
+        });
 
         return {
-            x: formatHour,
-            y: roundValue,
+            key,
+            id,
+            data,
         };
     });
-
-    return {
-        id,
-        data,
-    };
-});
+};
 
 export const normalizeFilteringStatus = (filteringStatus) => {
     const { enabled, filters, user_rules: userRules } = filteringStatus;
@@ -148,25 +148,38 @@ const (
 	ReasonRewrite
 )
 
-func (i Reason) String() string {
-	names := []string{
-		"NotFilteredNotFound",
-		"NotFilteredWhiteList",
-		"NotFilteredError",
+// reasonNames are the names of the reasons, indexed by their values
+var reasonNames = []string{
+	"NotFilteredNotFound",
+	"NotFilteredWhiteList",
+	"NotFilteredError",
+
+	"FilteredBlackList",
+	"FilteredSafeBrowsing",
+	"FilteredParental",
+	"FilteredInvalid",
+	"FilteredSafeSearch",
+	"FilteredBlockedService",
+
+	"Rewrite",
+}
 
-		"FilteredBlackList",
-		"FilteredSafeBrowsing",
-		"FilteredParental",
-		"FilteredInvalid",
-		"FilteredSafeSearch",
-		"FilteredBlockedService",
+// Reasons are all the known filtering result reasons, in the order of their values
+var Reasons = allReasons()
 
-		"Rewrite",
+func allReasons() []Reason {
+	reasons := make([]Reason, len(reasonNames))
+	for i := range reasonNames {
+		reasons[i] = Reason(i)
 	}
-	if uint(i) >= uint(len(names)) {
+	return reasons
+}
+
+func (i Reason) String() string {
+	if uint(i) >= uint(len(reasonNames)) {
 		return ""
 	}
-	return names[i]
+	return reasonNames[i]
 }
 
 type dnsFilterContext struct {
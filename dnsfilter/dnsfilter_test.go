@@ -521,6 +521,26 @@ func TestClientSettings(t *testing.T) {
 	assert.True(t, r.IsFiltered && r.Reason == FilteredBlockedService)
 }
 
+func TestReasons(t *testing.T) {
+	for i, reason := range Reasons {
+		if reason != Reason(i) {
+			t.Errorf("Reasons[%d] is %d", i, reason)
+		}
+		if reason.String() == "" {
+			t.Errorf("reason %d has no name", reason)
+		}
+	}
+	if name := Reason(len(Reasons)).String(); name != "" {
+		t.Errorf("reason %d is missing from Reasons", len(Reasons))
+	}
+	if len(Reasons) != int(ReasonRewrite)+1 {
+		t.Errorf("Reasons has %d values, the last reason is %d", len(Reasons), ReasonRewrite)
+	}
+	if name := FilteredBlackList.String(); name != "FilteredBlackList" {
+		t.Errorf("FilteredBlackList is named %s", name)
+	}
+}
+
 // BENCHMARKS
 
 func BenchmarkSafeBrowsing(b *testing.B) {
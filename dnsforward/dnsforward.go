@@ -2,12 +2,14 @@ package dnsforward
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
@@ -21,6 +23,9 @@ import (
 // DefaultTimeout is the default upstream timeout
 const DefaultTimeout = 10 * time.Second
 
+// logEntriesBufferSize is how many log entries may wait for the OnLogEntry sink before they're dropped
+const logEntriesBufferSize = 1000
+
 const (
 	safeBrowsingBlockHost = "standard-block.dns.adguard.com"
 	parentalBlockHost     = "family-block.dns.adguard.com"
@@ -37,6 +42,8 @@ const (
 //
 // The zero Server is empty and ready for use.
 type Server struct {
+	droppedLogEntries uint64 // log entries dropped because the OnLogEntry sink didn't keep up, keep first for alignment
+
 	dnsProxy  *proxy.Proxy         // DNS proxy instance
 	dnsFilter *dnsfilter.Dnsfilter // DNS filter instance
 	queryLog  *queryLog            // Query log instance
@@ -48,6 +55,11 @@ type Server struct {
 	DisallowedClientsIPNet []net.IPNet     // CIDRs of clients that should be blocked
 	BlockedHosts           map[string]bool // hosts that should be blocked
 
+	done chan struct{}  // closed by Close() to stop the periodic jobs
+	jobs sync.WaitGroup // periodic jobs started by NewServer
+
+	logEntries chan *logEntry // log entries waiting for the OnLogEntry sink
+
 	sync.RWMutex
 	conf ServerConfig
 }
@@ -57,8 +69,9 @@ type Server struct {
 // Note: this function must be called only once
 func NewServer(baseDir string) *Server {
 	s := &Server{
-		queryLog: newQueryLog(baseDir),
-		stats:    newStats(),
+		queryLog:   newQueryLog(baseDir),
+		stats:      newStats(),
+		logEntries: make(chan *logEntry, logEntriesBufferSize),
 	}
 
 	log.Tracef("Loading stats from querylog")
@@ -68,12 +81,95 @@ func NewServer(baseDir string) *Server {
 	}
 
 	log.Printf("Start DNS server periodic jobs")
-	go s.queryLog.periodicQueryLogRotate()
-	go s.queryLog.runningTop.periodicHourlyTopRotate()
-	go s.stats.statsRotator()
+	s.done = make(chan struct{})
+	s.startJob(s.queryLog.periodicQueryLogRotate)
+	s.startJob(s.queryLog.runningTop.periodicHourlyTopRotate)
+	s.startJob(s.stats.statsRotator)
+	s.startJob(s.logEntriesSender)
 	return s
 }
 
+// startJob runs a periodic job in a goroutine that is waited for by Close()
+func (s *Server) startJob(job func(done <-chan struct{})) {
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+		job(s.done)
+	}()
+}
+
+// Close stops the periodic jobs started by NewServer and waits until they exit
+// The DNS server must be stopped before calling Close and the Server must not be used afterwards
+func (s *Server) Close() {
+	if s.done == nil {
+		return // not created by NewServer
+	}
+	close(s.done)
+	s.jobs.Wait()
+}
+
+// sendLogEntry queues the entry for the OnLogEntry sink without blocking
+// the entry is dropped and counted if the queue is full
+func (s *Server) sendLogEntry(entry *logEntry) {
+	select {
+	case s.logEntries <- entry:
+	default:
+		atomic.AddUint64(&s.droppedLogEntries, 1)
+	}
+}
+
+// logEntriesSender passes the queued log entries to the OnLogEntry sink
+func (s *Server) logEntriesSender(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case entry := <-s.logEntries:
+			s.RLock()
+			sink := s.conf.OnLogEntry
+			s.RUnlock()
+			if sink != nil {
+				sink(newLogEntry(entry))
+			}
+		}
+	}
+}
+
+// LogEntry is a logged DNS request passed to the OnLogEntry sink
+type LogEntry struct {
+	Time     time.Time        `json:"time"`
+	Elapsed  time.Duration    `json:"elapsed_ns"`
+	Client   string           `json:"client"`
+	Host     string           `json:"host"`
+	QType    string           `json:"type"`
+	Result   dnsfilter.Result `json:"result"`
+	Upstream string           `json:"upstream,omitempty"` // empty if the answer was cached
+}
+
+// newLogEntry returns the log entry passed to the OnLogEntry sink
+// the question is unpacked here, so that it isn't done while the request is processed
+func newLogEntry(entry *logEntry) LogEntry {
+	e := LogEntry{
+		Time:     entry.Time,
+		Elapsed:  entry.Elapsed,
+		Client:   entry.IP,
+		Result:   entry.Result,
+		Upstream: entry.Upstream,
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(entry.Question); err == nil && len(q.Question) != 0 {
+		e.Host = strings.ToLower(strings.TrimSuffix(q.Question[0].Name, "."))
+		e.QType = dns.Type(q.Question[0].Qtype).String()
+	}
+	return e
+}
+
+// DroppedLogEntries returns the number of log entries that weren't passed to the OnLogEntry sink
+// because it didn't keep up with the requests
+func (s *Server) DroppedLogEntries() uint64 {
+	return atomic.LoadUint64(&s.droppedLogEntries)
+}
+
 // FilteringConfig represents the DNS filtering configuration of AdGuard Home
 // The zero FilteringConfig is empty and ready for use.
 type FilteringConfig struct {
@@ -88,6 +184,15 @@ type FilteringConfig struct {
 	BootstrapDNS       []string `yaml:"bootstrap_dns"`        // a list of bootstrap DNS for DoH and DoT (plain DNS only)
 	AllServers         bool     `yaml:"all_servers"`          // if true, parallel queries to all configured upstream servers are enabled
 
+	StatsTopRegistrableDomains bool `yaml:"stats_top_registrable_domains"` // if true, top domains are grouped by registrable domain (eTLD+1)
+	StatsTopExcludePTR         bool `yaml:"stats_top_exclude_ptr"`         // if true, reverse lookups (in-addr.arpa and ip6.arpa) aren't counted in top domains
+	StatsClientsIPv4PrefixLen  int  `yaml:"stats_clients_ipv4_prefix_len"` // if set (1..31), top IPv4 clients are grouped by subnet of this size
+	StatsClientsIPv6PrefixLen  int  `yaml:"stats_clients_ipv6_prefix_len"` // if set (1..127), top IPv6 clients are grouped by subnet of this size
+	StatsClientsMergeIPv6      bool `yaml:"stats_clients_merge_ipv6"`      // if true, top IPv6 clients are grouped by /64, so that the privacy addresses of a device are counted together
+
+	StatsTopExcludeSuffixes []string `yaml:"stats_top_exclude_suffixes"` // domains with these suffixes (e.g. "local") aren't counted in top domains
+	StatsDetailedClients    []string `yaml:"stats_detailed_clients"`     // if set, only these clients get their own top domains, otherwise the first clients of each hour do
+
 	AllowedClients    []string `yaml:"allowed_clients"`    // IP addresses of whitelist clients
 	DisallowedClients []string `yaml:"disallowed_clients"` // IP addresses of clients that should be blocked
 	BlockedHosts      []string `yaml:"blocked_hosts"`      // hosts that should be blocked
@@ -119,6 +224,7 @@ type ServerConfig struct {
 	DomainsReservedUpstreams map[string][]upstream.Upstream // Map of domains and lists of configured upstreams
 	Filters                  []dnsfilter.Filter             // A list of filters to use
 	OnDNSRequest             func(d *proxy.DNSContext)
+	OnLogEntry               func(entry LogEntry) // Receives every logged request, called from a single goroutine
 
 	FilteringConfig
 	TLSConfig
@@ -189,6 +295,7 @@ func (s *Server) startInternal(config *ServerConfig) error {
 	if err != nil {
 		return err
 	}
+	s.queryLog.runningTop.setConfig(newTopConfig(&s.conf))
 
 	proxyConfig := proxy.Config{
 		UDPListenAddr:            s.conf.UDPListenAddr,
@@ -356,6 +463,87 @@ func (s *Server) GetStatsTop() *StatsTop {
 	return s.queryLog.runningTop.getStatsTop()
 }
 
+// GetClientsSeen returns when the specified clients were first and last seen during the last 24 hours
+func (s *Server) GetClientsSeen(clients []string) map[string]ClientSeen {
+	s.RLock()
+	defer s.RUnlock()
+	return s.queryLog.runningTop.getClientsSeen(clients)
+}
+
+// TopMemEstimate returns the approximate number of bytes used by the top lists of the current hour
+func (s *Server) TopMemEstimate() int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.queryLog.runningTop.memEstimate()
+}
+
+// GetStatsTopForHour returns top stats for a single hour, the specified number of hours ago
+func (s *Server) GetStatsTopForHour(hour int) (*StatsTop, error) {
+	if hour < 0 || hour >= 24 {
+		return nil, fmt.Errorf("hour must be between 0 and 23: %d", hour)
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return s.queryLog.runningTop.getStatsTopRange(hour, hour), nil
+}
+
+// GroupStatsTop applies the configured grouping of domains and clients to the top stats
+// GetStatsTop doesn't group them, so that the clients can still be looked up one by one, e.g. with rDNS
+func (s *Server) GroupStatsTop(top *StatsTop) *StatsTop {
+	s.RLock()
+	defer s.RUnlock()
+	top.Domains = s.groupDomains(top.Domains)
+	top.Blocked = s.groupDomains(top.Blocked)
+	ipv4PrefixLen, ipv6PrefixLen := s.conf.clientsPrefixLens()
+	if ipv4PrefixLen != 0 || ipv6PrefixLen != 0 {
+		top.Clients = groupClientsBySubnet(top.Clients, ipv4PrefixLen, ipv6PrefixLen)
+		top.BlockedClients = groupClientsBySubnet(top.BlockedClients, ipv4PrefixLen, ipv6PrefixLen)
+		top.ClientsTime = groupClientsBySubnet(top.ClientsTime, ipv4PrefixLen, ipv6PrefixLen)
+	}
+	return top
+}
+
+// groupDomains applies the configured grouping to a top list, the excluded domains aren't counted at all
+func (s *Server) groupDomains(top map[string]int) map[string]int {
+	if s.conf.StatsTopRegistrableDomains {
+		top = groupByRegistrableDomain(top)
+	}
+	return top
+}
+
+// clientsPrefixLens returns the prefix lengths top clients are grouped by
+// merging IPv6 privacy addresses doesn't override a shorter IPv6 prefix length
+func (c *FilteringConfig) clientsPrefixLens() (int, int) {
+	ipv6PrefixLen := c.StatsClientsIPv6PrefixLen
+	if c.StatsClientsMergeIPv6 && (ipv6PrefixLen <= 0 || ipv6PrefixLen > 64) {
+		ipv6PrefixLen = 64
+	}
+	return c.StatsClientsIPv4PrefixLen, ipv6PrefixLen
+}
+
+// GetTopDomainsForClient returns the top domains requested by the specified client
+// an empty map is returned for unknown clients
+func (s *Server) GetTopDomainsForClient(client string) map[string]int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.groupDomains(s.queryLog.runningTop.getTopDomainsForClient(client))
+}
+
+// GetDomainCount returns the number of allowed and blocked queries for the specified host
+// during the last 24 hours.  Zeros are returned if the host wasn't queried.
+func (s *Server) GetDomainCount(host string) (allowed, blocked int) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.queryLog.runningTop.getDomainCount(host)
+}
+
+// GetTopBlockedByReason returns the top domains blocked for the specified reason
+func (s *Server) GetTopBlockedByReason(reason dnsfilter.Reason) map[string]int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.groupDomains(s.queryLog.runningTop.getTopBlockedByReason(reason))
+}
+
 // PurgeStats purges current server stats
 func (s *Server) PurgeStats() {
 	s.Lock()
@@ -363,11 +551,115 @@ func (s *Server) PurgeStats() {
 	s.stats.purgeStats()
 }
 
+// ClearTopLists clears the top domains and clients, the other stats and the unique counts are kept
+// the top lists are filled from the query log again on the next start
+func (s *Server) ClearTopLists() {
+	s.Lock()
+	defer s.Unlock()
+	s.queryLog.runningTop.clear()
+}
+
+// FlushQueryLog writes the buffered query log entries to the file right away
+// Stats are restored from the query log on startup, so this persists them too
+func (s *Server) FlushQueryLog() error {
+	return s.queryLog.flushLogBuffer(true)
+}
+
+// AggregatedStats is the stats data for the 24 hours along with the top lists data
+type AggregatedStats struct {
+	StatsResult
+	TopDroppedEntries   droppedEntries `json:"top_dropped_entries"`
+	UniqueClients       int            `json:"unique_clients"`
+	UniqueClientsHourly []int          `json:"unique_clients_hourly"`
+	AvgQueriesPerClient float64        `json:"avg_queries_per_client"`
+
+	UniqueDomains              int   `json:"unique_domains"`
+	UniqueDomainsHourly        []int `json:"unique_domains_hourly"`
+	UniqueBlockedDomains       int   `json:"unique_blocked_domains"`
+	UniqueBlockedDomainsHourly []int `json:"unique_blocked_domains_hourly"`
+}
+
+// GetAggregatedStatsResult returns aggregated stats data for the 24 hours
+func (s *Server) GetAggregatedStatsResult() AggregatedStats {
+	s.RLock()
+	defer s.RUnlock()
+	summed := AggregatedStats{
+		StatsResult:       s.stats.getAggregatedStats(),
+		TopDroppedEntries: s.queryLog.runningTop.getDropped(),
+	}
+	summed.UniqueClients, summed.UniqueClientsHourly = s.queryLog.runningTop.getUniqueClients()
+	summed.UniqueDomains, summed.UniqueDomainsHourly = s.queryLog.runningTop.getUniqueDomains()
+	summed.UniqueBlockedDomains, summed.UniqueBlockedDomainsHourly = s.queryLog.runningTop.getUniqueBlockedDomains()
+	summed.AvgQueriesPerClient = queriesPerClient(summed.DNSQueries, summed.UniqueClients)
+	return summed
+}
+
+// GetAggregatedStatsJSON returns aggregated stats data for the 24 hours encoded in JSON
+func (s *Server) GetAggregatedStatsJSON() ([]byte, error) {
+	return json.Marshal(s.GetAggregatedStatsResult())
+}
+
 // GetAggregatedStats returns aggregated stats data for the 24 hours
+// it's kept for the compatibility, use GetAggregatedStatsResult instead
 func (s *Server) GetAggregatedStats() map[string]interface{} {
+	data, err := s.GetAggregatedStatsJSON()
+	if err != nil {
+		log.Error("Couldn't encode stats: %s", err)
+		return nil
+	}
+	summed := map[string]interface{}{}
+	err = json.Unmarshal(data, &summed)
+	if err != nil {
+		log.Error("Couldn't decode stats: %s", err)
+		return nil
+	}
+	return summed
+}
+
+// GetTotalBlocked returns the number of requests blocked during the last 24 hours
+// it's cheaper than GetAggregatedStats if only this number is needed
+func (s *Server) GetTotalBlocked() uint64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.stats.getTotalBlocked()
+}
+
+// GetTotalQueries returns the number of requests from first to last hours ago, both inclusive
+func (s *Server) GetTotalQueries(first, last int) uint64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.stats.getTotalQueries(first, last)
+}
+
+// GetStatsToday returns stats data aggregated since the midnight in the specified location
+func (s *Server) GetStatsToday(loc *time.Location) StatsResult {
+	s.RLock()
+	defer s.RUnlock()
+	return s.stats.getStatsToday(time.Now(), loc)
+}
+
+// OldestTimestamp returns the approximate time of the oldest request in the hourly stats
+func (s *Server) OldestTimestamp() (time.Time, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	entries, lastRotate := s.stats.perHour.snapshotAt()
+	return oldestTimestamp(entries[s.stats.requests.name], statsHistoryElements-1, lastRotate)
+}
+
+// GetMovingAverage returns the hourly number of requests for the last 24 hours
+// smoothed with a trailing moving average over window hours
+func (s *Server) GetMovingAverage(window int) []float64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.stats.getMovingAverage(window)
+}
+
+// Forecast returns the expected number of requests for each of the next horizon hours (up to 24)
+// it's based on the same hours of the previous days, fewer values are returned if there is not enough history
+func (s *Server) Forecast(horizon int) []float64 {
 	s.RLock()
 	defer s.RUnlock()
-	return s.stats.getAggregatedStats()
+	return s.stats.getForecast(horizon)
 }
 
 // GetStatsHistory gets stats history aggregated by the specified time unit
@@ -381,6 +673,77 @@ func (s *Server) GetStatsHistory(timeUnit time.Duration, startTime time.Time, en
 	return s.stats.getStatsHistory(timeUnit, startTime, endTime)
 }
 
+// Subscribe returns a channel receiving the stats summary every interval (a second if it's not positive)
+// and a function that unsubscribes and closes the channel
+// a subscriber that doesn't keep up gets only the latest summary, the older one is dropped
+// the channel is also closed when the server is closed
+func (s *Server) Subscribe(interval time.Duration) (<-chan StatsSnapshot, func()) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ch := make(chan StatsSnapshot, 1)
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	s.startJob(func(done <-chan struct{}) {
+		defer close(exited)
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				s.RLock()
+				snapshot := s.stats.getSnapshot(now)
+				s.RUnlock()
+				sendDropOldest(ch, snapshot)
+			}
+		}
+	})
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() { close(stop) })
+		<-exited
+	}
+	return ch, unsubscribe
+}
+
+// sendDropOldest sends the snapshot without blocking, replacing the one that hasn't been received yet
+// ch must have a buffer and must have no other senders
+func sendDropOldest(ch chan StatsSnapshot, snapshot StatsSnapshot) {
+	for {
+		select {
+		case ch <- snapshot:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// GetTable returns the stats data of every period of the time unit as rows, from oldest to newest
+// timeUnit is either time.Second, time.Minute, time.Hour, or 24*time.Hour
+func (s *Server) GetTable(timeUnit time.Duration) ([]StatsRow, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.stats.getTable(timeUnit)
+}
+
+// GetHourlyDailyHistory returns the stats history for the last numHours hours and for the last numDays days
+// under the "hourly" and "daily" keys, the values are the same as returned by GetStatsHistory
+func (s *Server) GetHourlyDailyHistory(numHours, numDays int) map[string]interface{} {
+	s.RLock()
+	defer s.RUnlock()
+	return s.stats.getHourlyDailyHistory(numHours, numDays)
+}
+
 // Return TRUE if this client should be blocked
 func (s *Server) isBlockedIP(ip string) bool {
 	if len(s.AllowedClients) != 0 || len(s.AllowedClientsIPNet) != 0 {
@@ -498,8 +861,11 @@ func (s *Server) handleDNSRequest(p *proxy.Proxy, d *proxy.DNSContext) error {
 		if d.Upstream != nil {
 			upstreamAddr = d.Upstream.Address()
 		}
-		entry := s.queryLog.logRequest(msg, d.Res, res, elapsed, d.Addr, upstreamAddr)
+		entry := s.queryLog.logRequest(msg, d.Res, res, elapsed, d.Addr, upstreamAddr, d.Proto)
 		if entry != nil {
+			if s.conf.OnLogEntry != nil {
+				s.sendLogEntry(entry)
+			}
 			s.stats.incrementCounters(entry)
 		}
 	}
@@ -7,6 +7,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
 	"math/big"
 	"net"
@@ -691,3 +692,176 @@ func TestIsBlockedIPBlockedDomain(t *testing.T) {
 		t.Fatalf("isBlockedDomain")
 	}
 }
+
+func TestServerClose(t *testing.T) {
+	s := createTestServer(t)
+	defer removeDataDir(t)
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("periodic jobs didn't stop")
+	}
+}
+
+func TestFlushQueryLog(t *testing.T) {
+	s := createTestServer(t)
+	defer removeDataDir(t)
+
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 53}
+	entry := s.queryLog.logRequest(createGoogleATestMessage(), nil, nil, time.Millisecond, addr, "", "")
+	s.stats.incrementCounters(entry)
+	err := s.FlushQueryLog()
+	if err != nil {
+		t.Fatalf("FlushQueryLog(): %s", err)
+	}
+	s.Close()
+
+	// stats are restored from the flushed query log
+	s = createTestServer(t)
+	defer s.Close()
+	assert.Equal(t, 1.0, s.GetAggregatedStats()["dns_queries"])
+}
+
+func TestGroupStatsTop(t *testing.T) {
+	s := createTestServer(t)
+	defer removeDataDir(t)
+	defer s.Close()
+	s.conf.StatsClientsIPv4PrefixLen = 24
+
+	for _, ip := range []net.IP{{192, 168, 1, 10}, {192, 168, 1, 20}} {
+		addr := &net.UDPAddr{IP: ip, Port: 53}
+		s.queryLog.logRequest(createGoogleATestMessage(), nil, nil, time.Millisecond, addr, "", "udp")
+	}
+
+	// the clients are grouped only on request, e.g. rDNS needs the addresses
+	top := s.GetStatsTop()
+	assert.Equal(t, map[string]int{"192.168.1.10": 1, "192.168.1.20": 1}, top.Clients)
+	assert.Equal(t, map[string]int{"192.168.1.0/24": 2}, s.GroupStatsTop(top).Clients)
+}
+
+func TestGetAggregatedStatsJSON(t *testing.T) {
+	s := createTestServer(t)
+	defer removeDataDir(t)
+	defer s.Close()
+
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 53}
+	for _, host := range []string{"example.org", "example.net", "example.org"} {
+		entry := s.queryLog.logRequest(createTestMessage(host), nil, nil, time.Millisecond, addr, "8.8.8.8:53", "udp")
+		s.stats.incrementCounters(entry)
+	}
+
+	data, err := s.GetAggregatedStatsJSON()
+	if err != nil {
+		t.Fatalf("GetAggregatedStatsJSON(): %s", err)
+	}
+	legacy, err := json.Marshal(s.GetAggregatedStats())
+	if err != nil {
+		t.Fatalf("json.Marshal(): %s", err)
+	}
+	assert.JSONEq(t, string(legacy), string(data))
+
+	summed := s.GetAggregatedStatsResult()
+	assert.Equal(t, 3.0, summed.DNSQueries)
+	assert.Equal(t, 3.0, summed.CacheMisses)
+	assert.Equal(t, "24 hours", summed.StatsPeriod)
+	assert.Equal(t, 3.0, s.GetAggregatedStats()["dns_queries"])
+}
+
+func TestOnLogEntry(t *testing.T) {
+	s := createTestServer(t)
+	defer removeDataDir(t)
+	defer s.Close()
+
+	received := make(chan LogEntry, 1)
+	s.conf.OnLogEntry = func(entry LogEntry) {
+		received <- entry
+	}
+
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 53}
+	entry := s.queryLog.logRequest(createGoogleATestMessage(), nil, nil, time.Millisecond, addr, "", "udp")
+	s.sendLogEntry(entry)
+
+	select {
+	case e := <-received:
+		assert.Equal(t, entry.Time, e.Time)
+		assert.Equal(t, "127.0.0.1", e.Client)
+		assert.Equal(t, "google-public-dns-a.google.com", e.Host)
+		assert.Equal(t, "A", e.QType)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the sink didn't receive the entry")
+	}
+	assert.Equal(t, uint64(0), s.DroppedLogEntries())
+}
+
+func TestOnLogEntryOverflow(t *testing.T) {
+	// no sender is running, so nothing is taken from the queue
+	s := &Server{logEntries: make(chan *logEntry, 2)}
+	for i := 0; i < 5; i++ {
+		s.sendLogEntry(&logEntry{Time: time.Now()})
+	}
+	assert.Equal(t, uint64(3), s.DroppedLogEntries())
+	assert.Equal(t, 2, len(s.logEntries))
+}
+
+func TestSubscribe(t *testing.T) {
+	s := createTestServer(t)
+	defer removeDataDir(t)
+	defer s.Close()
+
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 53}
+	for i := 0; i < 2; i++ {
+		s.stats.incrementCounters(s.queryLog.logRequest(createGoogleATestMessage(), nil, nil, time.Millisecond, addr, "", "udp"))
+	}
+
+	receive := func(ch <-chan StatsSnapshot) StatsSnapshot {
+		select {
+		case snapshot, ok := <-ch:
+			if !ok {
+				t.Fatalf("the channel is closed")
+			}
+			return snapshot
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no snapshot received")
+		}
+		return StatsSnapshot{}
+	}
+
+	first, unsubscribeFirst := s.Subscribe(10 * time.Millisecond)
+	second, unsubscribeSecond := s.Subscribe(10 * time.Millisecond)
+	assert.Equal(t, 2.0, receive(first).DNSQueries)
+	assert.Equal(t, 2.0, receive(second).DNSQueries)
+
+	// the subscriber that doesn't read for a while gets the latest snapshot
+	time.Sleep(100 * time.Millisecond)
+	before := time.Now()
+	assert.False(t, receive(first).Time.Before(before.Add(-50*time.Millisecond)))
+
+	unsubscribeFirst()
+	unsubscribeFirst()
+	for range first {
+		// the channel is closed after the unread snapshot
+	}
+
+	// the other subscriber still gets the updates
+	receive(second)
+	receive(second)
+	unsubscribeSecond()
+	for range second {
+	}
+}
+
+func TestSendDropOldest(t *testing.T) {
+	ch := make(chan StatsSnapshot, 1)
+	sendDropOldest(ch, StatsSnapshot{DNSQueries: 1})
+	sendDropOldest(ch, StatsSnapshot{DNSQueries: 2})
+	sendDropOldest(ch, StatsSnapshot{DNSQueries: 3})
+	assert.Equal(t, 1, len(ch))
+	assert.Equal(t, 3.0, (<-ch).DNSQueries)
+}
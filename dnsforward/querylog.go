@@ -21,6 +21,13 @@ const (
 	queryLogFileName       = "querylog.json" // .gz added during compression
 	queryLogSize           = 5000            // maximum API response for /querylog
 	queryLogTopSize        = 500             // Keep in memory only top N values
+	queryLogTopMaxKeyLen   = 255             // Longer host names and client addresses aren't added to the top
+	queryLogTopMaxClients  = 10000           // Distinct clients remembered per hour, beyond it the count is a lower bound
+	queryLogTopMaxDomains  = 10000           // Distinct domains remembered per hour, beyond it the count is a lower bound
+
+	queryLogTopDetailedClients = 100 // Clients whose domains are remembered per hour, later clients get no per-client domains
+	queryLogTopClientDomains   = 100 // Keep in memory only top N domains of each client
+	queryLogTopEntryOverhead   = 64  // Approximate bytes used by a top entry besides its key, for the memory estimate
 )
 
 // queryLog is a structure that writes and reads the DNS query log
@@ -55,9 +62,10 @@ type logEntry struct {
 	Elapsed  time.Duration
 	IP       string
 	Upstream string `json:",omitempty"` // if empty, means it was cached
+	Proto    string `json:",omitempty"` // protocol the request was received over, see proxy.DNSContext.Proto
 }
 
-func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfilter.Result, elapsed time.Duration, addr net.Addr, upstream string) *logEntry {
+func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfilter.Result, elapsed time.Duration, addr net.Addr, upstream string, proto string) *logEntry {
 	var q []byte
 	var a []byte
 	var err error
@@ -92,6 +100,7 @@ func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfil
 		Elapsed:  elapsed,
 		IP:       ip,
 		Upstream: upstream,
+		Proto:    proto,
 	}
 
 	l.logBufferLock.Lock()
@@ -169,8 +169,16 @@ func (l *queryLog) rotateQueryLog() error {
 	return nil
 }
 
-func (l *queryLog) periodicQueryLogRotate() {
-	for range time.Tick(queryLogRotationPeriod) {
+func (l *queryLog) periodicQueryLogRotate(done <-chan struct{}) {
+	ticker := time.NewTicker(queryLogRotationPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
 		err := l.rotateQueryLog()
 		if err != nil {
 			log.Error("Failed to rotate querylog: %s", err)
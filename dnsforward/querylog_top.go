@@ -2,22 +2,37 @@ package dnsforward
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/bluele/gcache"
 	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
 )
 
 type hourTop struct {
-	domains gcache.Cache
-	blocked gcache.Cache
-	clients gcache.Cache
+	domains        gcache.Cache
+	blocked        gcache.Cache
+	blockedReasons gcache.Cache // "<reason> <host>" -> count
+	blockedLists   gcache.Cache // "<filter list ID>" -> count
+	clients        gcache.Cache
+	blockedClients gcache.Cache
+	clientsTime    gcache.Cache            // "<client>" -> summed processing time in microseconds
+	clientDomains  map[string]gcache.Cache // "<client>" -> "<host>" -> count, up to queryLogTopDetailedClients clients
+	uniqueClients  map[string]struct{}     // up to queryLogTopMaxClients clients, not limited by queryLogTopSize
+
+	uniqueDomains        map[string]struct{} // up to queryLogTopMaxDomains domains, not limited by queryLogTopSize
+	uniqueBlockedDomains map[string]struct{} // up to queryLogTopMaxDomains blocked domains
 
 	mutex sync.RWMutex
 }
@@ -25,15 +40,107 @@ type hourTop struct {
 func (h *hourTop) init() {
 	h.domains = gcache.New(queryLogTopSize).LRU().Build()
 	h.blocked = gcache.New(queryLogTopSize).LRU().Build()
+	h.blockedReasons = gcache.New(queryLogTopSize).LRU().Build()
+	h.blockedLists = gcache.New(queryLogTopSize).LRU().Build()
 	h.clients = gcache.New(queryLogTopSize).LRU().Build()
+	h.blockedClients = gcache.New(queryLogTopSize).LRU().Build()
+	h.clientsTime = gcache.New(queryLogTopSize).LRU().Build()
+	h.clientDomains = map[string]gcache.Cache{}
+	h.uniqueClients = map[string]struct{}{}
+	h.uniqueDomains = map[string]struct{}{}
+	h.uniqueBlockedDomains = map[string]struct{}{}
+}
+
+// droppedEntries counts the entries that weren't added to the top stats, by reason
+// the counters are updated atomically and must stay 64-bit aligned
+type droppedEntries struct {
+	TooOld     uint64 `json:"too_old"`     // entry is more than 24 hours old
+	NoQuestion uint64 `json:"no_question"` // DNS message has no questions
+	EmptyHost  uint64 `json:"empty_host"`  // question name is empty
+	TooLong    uint64 `json:"too_long"`    // host name or client address is longer than queryLogTopMaxKeyLen
 }
 
 type dayTop struct {
+	dropped droppedEntries // keep first for alignment
+
 	hours     []*hourTop
 	hoursLock sync.RWMutex // writelock this lock ONLY WHEN rotating or intializing hours!
 
 	loaded     bool
 	loadedLock sync.Mutex
+
+	conf     topConfig
+	confLock sync.RWMutex
+}
+
+// topConfig is the part of the server configuration that decides what is counted in the top stats
+type topConfig struct {
+	detailedClients  map[string]bool // if not empty, only these clients get their own top domains
+	excludedSuffixes []string        // domains equal to or under these suffixes aren't counted in the top domains
+}
+
+func newTopConfig(c *ServerConfig) topConfig {
+	conf := topConfig{
+		excludedSuffixes: excludedSuffixes(c.StatsTopExcludePTR, c.StatsTopExcludeSuffixes),
+	}
+	convertArrayToMap(&conf.detailedClients, c.StatsDetailedClients)
+	return conf
+}
+
+// setConfig applies the configuration to the new entries and removes what it excludes from the counted ones
+// the query log is replayed before the server is configured, so the replayed entries are filtered here
+func (d *dayTop) setConfig(conf topConfig) {
+	d.confLock.Lock()
+	d.conf = conf
+	d.confLock.Unlock()
+
+	if len(conf.detailedClients) == 0 && len(conf.excludedSuffixes) == 0 {
+		return
+	}
+	excluded := func(host string) bool { return hasDomainSuffix(host, conf.excludedSuffixes) }
+	excludedReason := func(key string) bool { return excluded(key[strings.Index(key, " ")+1:]) }
+
+	d.hoursReadLock()
+	for _, h := range d.hours {
+		h.Lock()
+		for client, cache := range h.clientDomains {
+			if len(conf.detailedClients) != 0 && !conf.detailedClients[client] {
+				delete(h.clientDomains, client)
+				continue
+			}
+			removeKeys(cache, excluded)
+		}
+		if len(conf.excludedSuffixes) != 0 {
+			removeKeys(h.domains, excluded)
+			removeKeys(h.blocked, excluded)
+			removeKeys(h.blockedReasons, excludedReason)
+			for _, set := range []map[string]struct{}{h.uniqueDomains, h.uniqueBlockedDomains} {
+				for host := range set {
+					if excluded(host) {
+						delete(set, host)
+					}
+				}
+			}
+		}
+		h.Unlock()
+	}
+	d.hoursReadUnlock()
+}
+
+// removeKeys removes the keys for which remove returns true from the cache
+func removeKeys(cache gcache.Cache, remove func(key string) bool) {
+	for _, ikey := range cache.Keys(false) {
+		key, ok := ikey.(string)
+		if ok && remove(key) {
+			cache.Remove(key)
+		}
+	}
+}
+
+func (d *dayTop) getConfig() topConfig {
+	d.confLock.RLock()
+	defer d.confLock.RUnlock()
+	return d.conf
 }
 
 func (d *dayTop) init() {
@@ -56,20 +163,45 @@ func (d *dayTop) rotateHourlyTop() {
 	d.hoursWriteUnlock()
 }
 
-func (d *dayTop) periodicHourlyTopRotate() {
-	t := time.Hour
-	for range time.Tick(t) {
-		d.rotateHourlyTop()
+// clear removes all the top lists, the dropped entries counters and the unique clients and domains are kept
+// so that the unique counts still match the totals, which aren't cleared either
+func (d *dayTop) clear() {
+	d.hoursWriteLock()
+	for i, old := range d.hours {
+		hour := &hourTop{}
+		hour.init()
+		hour.uniqueClients = old.uniqueClients
+		hour.uniqueDomains = old.uniqueDomains
+		hour.uniqueBlockedDomains = old.uniqueBlockedDomains
+		d.hours[i] = hour
+	}
+	d.hoursWriteUnlock()
+}
+
+func (d *dayTop) periodicHourlyTopRotate(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			d.rotateHourlyTop()
+		}
 	}
 }
 
 func (h *hourTop) incrementValue(key string, cache gcache.Cache) error {
+	return h.addValue(key, cache, 1)
+}
+
+func (h *hourTop) addValue(key string, cache gcache.Cache, delta int) error {
 	h.Lock()
 	defer h.Unlock()
 	ivalue, err := cache.Get(key)
 	if err == gcache.KeyNotFoundError {
 		// we just set it and we're done
-		err = cache.Set(key, 1)
+		err = cache.Set(key, delta)
 		if err != nil {
 			log.Printf("Failed to set hourly top value: %s", err)
 			return err
@@ -89,7 +221,7 @@ func (h *hourTop) incrementValue(key string, cache gcache.Cache) error {
 		return err
 	}
 
-	err = cache.Set(key, cachedValue+1)
+	err = cache.Set(key, cachedValue+delta)
 	if err != nil {
 		log.Printf("Failed to set hourly top value: %s", err)
 		return err
@@ -98,17 +230,65 @@ func (h *hourTop) incrementValue(key string, cache gcache.Cache) error {
 }
 
 func (h *hourTop) incrementDomains(key string) error {
+	h.Lock()
+	if len(h.uniqueDomains) < queryLogTopMaxDomains {
+		h.uniqueDomains[key] = struct{}{}
+	}
+	h.Unlock()
 	return h.incrementValue(key, h.domains)
 }
 
 func (h *hourTop) incrementBlocked(key string) error {
+	h.Lock()
+	if len(h.uniqueBlockedDomains) < queryLogTopMaxDomains {
+		h.uniqueBlockedDomains[key] = struct{}{}
+	}
+	h.Unlock()
 	return h.incrementValue(key, h.blocked)
 }
 
+func (h *hourTop) incrementBlockedReasons(reason dnsfilter.Reason, host string) error {
+	return h.incrementValue(blockedReasonKey(reason, host), h.blockedReasons)
+}
+
+func (h *hourTop) incrementBlockedLists(filterID int64) error {
+	return h.incrementValue(strconv.FormatInt(filterID, 10), h.blockedLists)
+}
+
 func (h *hourTop) incrementClients(key string) error {
+	h.Lock()
+	if len(h.uniqueClients) < queryLogTopMaxClients {
+		h.uniqueClients[key] = struct{}{}
+	}
+	h.Unlock()
 	return h.incrementValue(key, h.clients)
 }
 
+func (h *hourTop) incrementBlockedClients(key string) error {
+	return h.incrementValue(key, h.blockedClients)
+}
+
+func (h *hourTop) addClientsTime(key string, elapsed time.Duration) error {
+	return h.addValue(key, h.clientsTime, int(elapsed/time.Microsecond))
+}
+
+// incrementClientDomains counts the host in the client's own cache
+// so that a busy client can't push the domains of the other clients out
+func (h *hourTop) incrementClientDomains(client, host string) error {
+	h.Lock()
+	cache, ok := h.clientDomains[client]
+	if !ok {
+		if len(h.clientDomains) >= queryLogTopDetailedClients {
+			h.Unlock()
+			return nil
+		}
+		cache = gcache.New(queryLogTopClientDomains).LRU().Build()
+		h.clientDomains[client] = cache
+	}
+	h.Unlock()
+	return h.incrementValue(host, cache)
+}
+
 // if does not exist -- return 0
 func (h *hourTop) lockedGetValue(key string, cache gcache.Cache) (int, error) {
 	ivalue, err := cache.Get(key)
@@ -139,20 +319,46 @@ func (h *hourTop) lockedGetBlocked(key string) (int, error) {
 	return h.lockedGetValue(key, h.blocked)
 }
 
+func (h *hourTop) lockedGetBlockedReasons(key string) (int, error) {
+	return h.lockedGetValue(key, h.blockedReasons)
+}
+
+func (h *hourTop) lockedGetBlockedLists(key string) (int, error) {
+	return h.lockedGetValue(key, h.blockedLists)
+}
+
 func (h *hourTop) lockedGetClients(key string) (int, error) {
 	return h.lockedGetValue(key, h.clients)
 }
 
+func (h *hourTop) lockedGetBlockedClients(key string) (int, error) {
+	return h.lockedGetValue(key, h.blockedClients)
+}
+
+func (h *hourTop) lockedGetClientsTime(key string) (int, error) {
+	return h.lockedGetValue(key, h.clientsTime)
+}
+
+func (h *hourTop) lockedGetClientDomains(client, host string) (int, error) {
+	cache, ok := h.clientDomains[client]
+	if !ok {
+		return 0, nil
+	}
+	return h.lockedGetValue(host, cache)
+}
+
 func (d *dayTop) addEntry(entry *logEntry, q *dns.Msg, now time.Time) error {
 	// figure out which hour bucket it belongs to
 	hour := int(now.Sub(entry.Time).Hours())
 	if hour >= 24 {
 		log.Printf("t %v is >24 hours ago, ignoring", entry.Time)
+		atomic.AddUint64(&d.dropped.TooOld, 1)
 		return nil
 	}
 
 	// if a DNS query doesn't have questions, do nothing
 	if len(q.Question) == 0 {
+		atomic.AddUint64(&d.dropped.NoQuestion, 1)
 		return nil
 	}
 
@@ -160,32 +366,83 @@ func (d *dayTop) addEntry(entry *logEntry, q *dns.Msg, now time.Time) error {
 
 	// if question hostname is empty, do nothing
 	if hostname == "" {
+		atomic.AddUint64(&d.dropped.EmptyHost, 1)
+		return nil
+	}
+
+	// don't let bogus names or addresses bloat the top caches
+	if len(hostname) > queryLogTopMaxKeyLen || len(entry.IP) > queryLogTopMaxKeyLen {
+		atomic.AddUint64(&d.dropped.TooLong, 1)
 		return nil
 	}
 
+	conf := d.getConfig()
+	// the excluded domains aren't counted in the domain lists, but their clients still are
+	excluded := hasDomainSuffix(hostname, conf.excludedSuffixes)
+
 	// get value, if not set, crate one
 	d.hoursReadLock()
 	defer d.hoursReadUnlock()
-	err := d.hours[hour].incrementDomains(hostname)
-	if err != nil {
-		log.Printf("Failed to increment value: %s", err)
-		return err
-	}
-
-	if entry.Result.IsFiltered {
-		err := d.hours[hour].incrementBlocked(hostname)
+	if !excluded {
+		err := d.hours[hour].incrementDomains(hostname)
 		if err != nil {
 			log.Printf("Failed to increment value: %s", err)
 			return err
 		}
 	}
 
+	if entry.Result.IsFiltered {
+		if !excluded {
+			err := d.hours[hour].incrementBlocked(hostname)
+			if err != nil {
+				log.Printf("Failed to increment value: %s", err)
+				return err
+			}
+
+			err = d.hours[hour].incrementBlockedReasons(entry.Result.Reason, hostname)
+			if err != nil {
+				log.Printf("Failed to increment value: %s", err)
+				return err
+			}
+		}
+
+		if entry.Result.Reason == dnsfilter.FilteredBlackList {
+			err := d.hours[hour].incrementBlockedLists(entry.Result.FilterID)
+			if err != nil {
+				log.Printf("Failed to increment value: %s", err)
+				return err
+			}
+		}
+	}
+
 	if len(entry.IP) > 0 {
 		err := d.hours[hour].incrementClients(entry.IP)
 		if err != nil {
 			log.Printf("Failed to increment value: %s", err)
 			return err
 		}
+
+		if !excluded && (len(conf.detailedClients) == 0 || conf.detailedClients[entry.IP]) {
+			err = d.hours[hour].incrementClientDomains(entry.IP, hostname)
+			if err != nil {
+				log.Printf("Failed to increment value: %s", err)
+				return err
+			}
+		}
+
+		err = d.hours[hour].addClientsTime(entry.IP, entry.Elapsed)
+		if err != nil {
+			log.Printf("Failed to increment value: %s", err)
+			return err
+		}
+
+		if entry.Result.IsFiltered {
+			err = d.hours[hour].incrementBlockedClients(entry.IP)
+			if err != nil {
+				log.Printf("Failed to increment value: %s", err)
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -249,19 +506,111 @@ func (l *queryLog) fillStatsFromQueryLog(s *stats) error {
 	return nil
 }
 
+// getDropped returns the number of entries that weren't added to the top stats
+func (d *dayTop) getDropped() droppedEntries {
+	return droppedEntries{
+		TooOld:     atomic.LoadUint64(&d.dropped.TooOld),
+		NoQuestion: atomic.LoadUint64(&d.dropped.NoQuestion),
+		EmptyHost:  atomic.LoadUint64(&d.dropped.EmptyHost),
+		TooLong:    atomic.LoadUint64(&d.dropped.TooLong),
+	}
+}
+
 // StatsTop represents top stat charts
 type StatsTop struct {
 	Domains map[string]int // Domains - top requested domains
 	Blocked map[string]int // Blocked - top blocked domains
 	Clients map[string]int // Clients - top DNS clients
+	Lists   map[string]int // Lists - filter list IDs with the most blocked requests
+
+	BlockedClients map[string]int // BlockedClients - DNS clients with the most blocked requests
+	ClientsTime    map[string]int // ClientsTime - DNS clients with the most summed processing time, in microseconds
+}
+
+// DomainStats is the number of allowed and blocked requests for a domain
+type DomainStats struct {
+	Name    string `json:"name"`
+	Allowed int    `json:"allowed"`
+	Blocked int    `json:"blocked"`
+}
+
+// DetailedDomains returns up to n top domains with allowed and blocked requests counted separately
+// the domains are ordered by the total number of requests
+func (s *StatsTop) DetailedDomains(n int) []DomainStats {
+	result := []DomainStats{}
+	for name, total := range s.Domains {
+		blocked := s.Blocked[name]
+		if blocked > total {
+			blocked = total // the counters are evicted from the top caches independently
+		}
+		result = append(result, DomainStats{Name: name, Allowed: total - blocked, Blocked: blocked})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		ti := result[i].Allowed + result[i].Blocked
+		tj := result[j].Allowed + result[j].Blocked
+		if ti != tj {
+			return ti > tj
+		}
+		return result[i].Name < result[j].Name
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// ClientStats is the number of all and blocked requests from a client
+type ClientStats struct {
+	IP      string  `json:"ip"`
+	Total   int     `json:"total"`
+	Blocked int     `json:"blocked"`
+	Ratio   float64 `json:"ratio"` // share of blocked requests, 0 if there were no requests
+}
+
+// DetailedClients returns up to n top clients with their blocked requests
+// the clients are ordered by the total number of requests
+func (s *StatsTop) DetailedClients(n int) []ClientStats {
+	result := []ClientStats{}
+	for ip, total := range s.Clients {
+		blocked := s.BlockedClients[ip]
+		if blocked > total {
+			blocked = total // the counters are evicted from the top caches independently
+		}
+		c := ClientStats{IP: ip, Total: total, Blocked: blocked}
+		if total != 0 {
+			c.Ratio = float64(blocked) / float64(total)
+		}
+		result = append(result, c)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Total != result[j].Total {
+			return result[i].Total > result[j].Total
+		}
+		return result[i].IP < result[j].IP
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
 }
 
 // getStatsTop returns the current top stats
 func (d *dayTop) getStatsTop() *StatsTop {
+	return d.getStatsTopRange(0, 23)
+}
+
+// getStatsTopRange returns the top stats from first to last hours ago, both inclusive
+func (d *dayTop) getStatsTopRange(first, last int) *StatsTop {
 	s := &StatsTop{
 		Domains: map[string]int{},
 		Blocked: map[string]int{},
 		Clients: map[string]int{},
+		Lists:   map[string]int{},
+
+		BlockedClients: map[string]int{},
+		ClientsTime:    map[string]int{},
 	}
 
 	do := func(keys []interface{}, getter func(key string) (int, error), result map[string]int) {
@@ -280,11 +629,14 @@ func (d *dayTop) getStatsTop() *StatsTop {
 	}
 
 	d.hoursReadLock()
-	for hour := 0; hour < 24; hour++ {
+	for hour := first; hour <= last; hour++ {
 		d.hours[hour].RLock()
 		do(d.hours[hour].domains.Keys(false), d.hours[hour].lockedGetDomains, s.Domains)
 		do(d.hours[hour].blocked.Keys(false), d.hours[hour].lockedGetBlocked, s.Blocked)
 		do(d.hours[hour].clients.Keys(false), d.hours[hour].lockedGetClients, s.Clients)
+		do(d.hours[hour].blockedLists.Keys(false), d.hours[hour].lockedGetBlockedLists, s.Lists)
+		do(d.hours[hour].blockedClients.Keys(false), d.hours[hour].lockedGetBlockedClients, s.BlockedClients)
+		do(d.hours[hour].clientsTime.Keys(false), d.hours[hour].lockedGetClientsTime, s.ClientsTime)
 		d.hours[hour].RUnlock()
 	}
 	d.hoursReadUnlock()
@@ -292,6 +644,279 @@ func (d *dayTop) getStatsTop() *StatsTop {
 	return s
 }
 
+// getDomainCount returns the number of allowed and blocked queries for the specified host
+func (d *dayTop) getDomainCount(host string) (allowed, blocked int) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	total := 0
+
+	d.hoursReadLock()
+	for hour := 0; hour < 24; hour++ {
+		h := d.hours[hour]
+		h.RLock()
+		value, err := h.lockedGetDomains(host)
+		if err == nil {
+			total += value
+		}
+		value, err = h.lockedGetBlocked(host)
+		if err == nil {
+			blocked += value
+		}
+		h.RUnlock()
+	}
+	d.hoursReadUnlock()
+
+	if blocked > total {
+		blocked = total
+	}
+	return total - blocked, blocked
+}
+
+// getUniqueClients returns the number of distinct clients for the last 24 hours
+// and for every hour of it, from the oldest to the newest
+// only queryLogTopMaxClients clients are remembered per hour, so the numbers are a lower bound
+func (d *dayTop) getUniqueClients() (int, []int) {
+	return d.getUnique(func(h *hourTop) map[string]struct{} { return h.uniqueClients })
+}
+
+// getUniqueDomains returns the number of distinct queried domains for the last 24 hours
+// and for every hour of it, from the oldest to the newest
+// only queryLogTopMaxDomains domains are remembered per hour, so the numbers are a lower bound
+func (d *dayTop) getUniqueDomains() (int, []int) {
+	return d.getUnique(func(h *hourTop) map[string]struct{} { return h.uniqueDomains })
+}
+
+// getUniqueBlockedDomains is getUniqueDomains for the blocked domains
+func (d *dayTop) getUniqueBlockedDomains() (int, []int) {
+	return d.getUnique(func(h *hourTop) map[string]struct{} { return h.uniqueBlockedDomains })
+}
+
+// getUnique returns the number of distinct keys of the hourly sets for the last 24 hours
+// and for every hour of it, from the oldest to the newest
+func (d *dayTop) getUnique(set func(h *hourTop) map[string]struct{}) (int, []int) {
+	all := map[string]struct{}{}
+	hourly := make([]int, 24)
+
+	d.hoursReadLock()
+	for hour := 0; hour < 24; hour++ {
+		h := d.hours[hour]
+		h.RLock()
+		keys := set(h)
+		hourly[23-hour] = len(keys)
+		for key := range keys {
+			all[key] = struct{}{}
+		}
+		h.RUnlock()
+	}
+	d.hoursReadUnlock()
+
+	return len(all), hourly
+}
+
+// ClientSeen is when a client was first and last seen during the last 24 hours
+// the values are in hours ago, the current hour is 0
+type ClientSeen struct {
+	FirstSeen int `json:"first_seen_hours_ago"`
+	LastSeen  int `json:"last_seen_hours_ago"`
+}
+
+// getClientsSeen returns when the specified clients were first and last seen
+// the clients not seen during the last 24 hours are left out
+func (d *dayTop) getClientsSeen(clients []string) map[string]ClientSeen {
+	result := map[string]ClientSeen{}
+
+	d.hoursReadLock()
+	for hour := 0; hour < 24; hour++ {
+		h := d.hours[hour]
+		h.RLock()
+		for _, client := range clients {
+			if _, ok := h.uniqueClients[client]; !ok {
+				continue
+			}
+			seen, ok := result[client]
+			if !ok {
+				seen.LastSeen = hour
+			}
+			seen.FirstSeen = hour
+			result[client] = seen
+		}
+		h.RUnlock()
+	}
+	d.hoursReadUnlock()
+
+	return result
+}
+
+// getTopDomainsForClient returns the top domains requested by the specified client
+func (d *dayTop) getTopDomainsForClient(client string) map[string]int {
+	result := map[string]int{}
+
+	d.hoursReadLock()
+	for hour := 0; hour < 24; hour++ {
+		h := d.hours[hour]
+		h.RLock()
+		cache, ok := h.clientDomains[client]
+		if !ok {
+			h.RUnlock()
+			continue
+		}
+		for _, ikey := range cache.Keys(false) {
+			key, ok := ikey.(string)
+			if !ok {
+				continue
+			}
+			value, err := h.lockedGetClientDomains(client, key)
+			if err != nil {
+				log.Printf("Failed to get top client domains value for %v: %s", key, err)
+				continue
+			}
+			result[key] += value
+		}
+		h.RUnlock()
+	}
+	d.hoursReadUnlock()
+
+	return result
+}
+
+// memEstimate approximates the bytes used by the top lists of the current hour
+// each entry is counted as its key length plus queryLogTopEntryOverhead
+func (d *dayTop) memEstimate() int {
+	d.hoursReadLock()
+	defer d.hoursReadUnlock()
+	h := d.hours[0]
+	h.RLock()
+	defer h.RUnlock()
+
+	size := 0
+	for _, cache := range []gcache.Cache{h.domains, h.blocked, h.blockedReasons, h.blockedLists, h.clients, h.blockedClients, h.clientsTime} {
+		size += cacheMemEstimate(cache)
+	}
+	for client, cache := range h.clientDomains {
+		size += len(client) + queryLogTopEntryOverhead + cacheMemEstimate(cache)
+	}
+	for _, set := range []map[string]struct{}{h.uniqueClients, h.uniqueDomains, h.uniqueBlockedDomains} {
+		for key := range set {
+			size += len(key) + queryLogTopEntryOverhead
+		}
+	}
+	return size
+}
+
+func cacheMemEstimate(cache gcache.Cache) int {
+	size := 0
+	for _, ikey := range cache.Keys(false) {
+		key, _ := ikey.(string)
+		size += len(key) + queryLogTopEntryOverhead
+	}
+	return size
+}
+
+// blockedReasonKey returns the key of the blocked domain counter for the specified reason
+func blockedReasonKey(reason dnsfilter.Reason, host string) string {
+	return strconv.Itoa(int(reason)) + " " + host
+}
+
+// getTopBlockedByReason returns the top domains blocked for the specified reason
+func (d *dayTop) getTopBlockedByReason(reason dnsfilter.Reason) map[string]int {
+	result := map[string]int{}
+	prefix := blockedReasonKey(reason, "")
+
+	d.hoursReadLock()
+	for hour := 0; hour < 24; hour++ {
+		h := d.hours[hour]
+		h.RLock()
+		for _, ikey := range h.blockedReasons.Keys(false) {
+			key, ok := ikey.(string)
+			if !ok || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			value, err := h.lockedGetBlockedReasons(key)
+			if err != nil {
+				log.Printf("Failed to get top blocked value for %v: %s", key, err)
+				continue
+			}
+			result[strings.TrimPrefix(key, prefix)] += value
+		}
+		h.RUnlock()
+	}
+	d.hoursReadUnlock()
+
+	return result
+}
+
+// reverseLookupSuffixes are the suffixes of the reverse lookup domains
+var reverseLookupSuffixes = []string{"in-addr.arpa", "ip6.arpa"}
+
+// excludedSuffixes returns the reverse lookup suffixes, if ptr is true, and the normalized suffixes
+func excludedSuffixes(ptr bool, suffixes []string) []string {
+	excluded := []string{}
+	if ptr {
+		excluded = append(excluded, reverseLookupSuffixes...)
+	}
+	for _, suffix := range suffixes {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		if suffix != "" {
+			excluded = append(excluded, suffix)
+		}
+	}
+	return excluded
+}
+
+// hasDomainSuffix returns true if the host is equal to or is a subdomain of one of the suffixes
+func hasDomainSuffix(host string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupByRegistrableDomain sums up the counters of the domains with the same eTLD+1
+// domains that are public suffixes themselves are left as is
+func groupByRegistrableDomain(top map[string]int) map[string]int {
+	result := map[string]int{}
+	for host, count := range top {
+		domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+		if err != nil {
+			domain = host
+		}
+		result[domain] += count
+	}
+	return result
+}
+
+// groupClientsBySubnet sums up the counters of the clients within the same subnet
+// addresses of a family with the prefix length out of range are left as is
+func groupClientsBySubnet(top map[string]int, ipv4PrefixLen, ipv6PrefixLen int) map[string]int {
+	result := map[string]int{}
+	for client, count := range top {
+		result[clientSubnet(client, ipv4PrefixLen, ipv6PrefixLen)] += count
+	}
+	return result
+}
+
+// clientSubnet returns the subnet of the client IP address in CIDR notation
+func clientSubnet(client string, ipv4PrefixLen, ipv6PrefixLen int) string {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return client
+	}
+
+	bits, prefixLen := 128, ipv6PrefixLen
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits, prefixLen = 32, ipv4PrefixLen
+	}
+	if prefixLen <= 0 || prefixLen >= bits {
+		return client
+	}
+
+	mask := net.CIDRMask(prefixLen, bits)
+	subnet := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return subnet.String()
+}
+
 func (d *dayTop) hoursWriteLock()    { tracelock(); d.hoursLock.Lock() }
 func (d *dayTop) hoursWriteUnlock()  { tracelock(); d.hoursLock.Unlock() }
 func (d *dayTop) hoursReadLock()     { tracelock(); d.hoursLock.RLock() }
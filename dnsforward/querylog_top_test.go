@@ -0,0 +1,466 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func createTestTop() *dayTop {
+	d := &dayTop{}
+	d.init()
+	return d
+}
+
+func addTestTopEntry(t *testing.T, d *dayTop, host, ip string) {
+	entry := &logEntry{Time: time.Now(), IP: ip}
+	err := d.addEntry(entry, createTestMessage(host), time.Now())
+	if err != nil {
+		t.Fatalf("addEntry(): %s", err)
+	}
+}
+
+func TestTopDomainCaseFolding(t *testing.T) {
+	d := createTestTop()
+	addTestTopEntry(t, d, "Example.COM.", "1.2.3.4")
+	addTestTopEntry(t, d, "example.com.", "1.2.3.4")
+	addTestTopEntry(t, d, "EXAMPLE.com.", "1.2.3.4")
+
+	top := d.getStatsTop()
+	assert.Equal(t, 1, len(top.Domains))
+	assert.Equal(t, 3, top.Domains["example.com"])
+}
+
+func TestTopDomainTrailingDot(t *testing.T) {
+	d := createTestTop()
+	addTestTopEntry(t, d, "example.com.", "1.2.3.4")
+	addTestTopEntry(t, d, "example.com", "1.2.3.4")
+
+	top := d.getStatsTop()
+	assert.Equal(t, map[string]int{"example.com": 2}, top.Domains)
+}
+
+func TestExcludedSuffixes(t *testing.T) {
+	assert.Equal(t, []string{"in-addr.arpa", "ip6.arpa"}, excludedSuffixes(true, nil))
+	assert.Equal(t, []string{"local", "lan"}, excludedSuffixes(false, []string{".local", "LAN.", ""}))
+}
+
+func TestTopExcludedDomains(t *testing.T) {
+	d := createTestTop()
+	blocked := &logEntry{Time: time.Now(), IP: "1.2.3.4", Result: dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList}}
+	err := d.addEntry(blocked, createTestMessage("ads.lan."), time.Now())
+	assert.Nil(t, err)
+	addTestTopEntry(t, d, "printer.local.", "1.2.3.4")
+
+	// the entries counted before the server is configured are removed
+	conf := &ServerConfig{FilteringConfig: FilteringConfig{StatsTopExcludePTR: true, StatsTopExcludeSuffixes: []string{"local", "lan"}}}
+	d.setConfig(newTopConfig(conf))
+	addTestTopEntry(t, d, "1.0.168.192.in-addr.arpa.", "1.2.3.4")
+	addTestTopEntry(t, d, "nas.lan.", "1.2.3.4")
+	addTestTopEntry(t, d, "notlocal.", "1.2.3.4")
+
+	top := d.getStatsTop()
+	assert.Equal(t, map[string]int{"notlocal": 1}, top.Domains)
+	assert.Equal(t, map[string]int{}, top.Blocked)
+	assert.Equal(t, map[string]int{"1.2.3.4": 5}, top.Clients)
+	assert.Equal(t, map[string]int{"1.2.3.4": 1}, top.BlockedClients)
+	assert.Equal(t, map[string]int{"notlocal": 1}, d.getTopDomainsForClient("1.2.3.4"))
+	assert.Equal(t, map[string]int{}, d.getTopBlockedByReason(dnsfilter.FilteredBlackList))
+	unique, _ := d.getUniqueDomains()
+	assert.Equal(t, 1, unique)
+}
+
+func TestGroupByRegistrableDomain(t *testing.T) {
+	top := map[string]int{
+		"example.org":          1,
+		"www.example.org":      2,
+		"a.b.cdn.example.org":  3,
+		"bbc.co.uk":            4,
+		"news.bbc.co.uk":       5,
+		"co.uk":                6,
+		"localhost":            7,
+		"user.github.io":       8,
+		"other.user.github.io": 9,
+	}
+	grouped := groupByRegistrableDomain(top)
+	assert.Equal(t, map[string]int{
+		"example.org":    6,
+		"bbc.co.uk":      9,
+		"co.uk":          6,
+		"localhost":      7,
+		"user.github.io": 17,
+	}, grouped)
+}
+
+func TestTopDroppedEntries(t *testing.T) {
+	d := createTestTop()
+	now := time.Now()
+
+	err := d.addEntry(&logEntry{Time: now.Add(-25 * time.Hour)}, createGoogleATestMessage(), now)
+	assert.Nil(t, err)
+	err = d.addEntry(&logEntry{Time: now}, &dns.Msg{}, now)
+	assert.Nil(t, err)
+	err = d.addEntry(&logEntry{Time: now}, createTestMessage("."), now)
+	assert.Nil(t, err)
+	err = d.addEntry(&logEntry{Time: now}, createTestMessage("."), now)
+	assert.Nil(t, err)
+	err = d.addEntry(&logEntry{Time: now}, createTestMessage(strings.Repeat("a", queryLogTopMaxKeyLen)+".org."), now)
+	assert.Nil(t, err)
+	err = d.addEntry(&logEntry{Time: now, IP: strings.Repeat("1", queryLogTopMaxKeyLen+1)}, createTestMessage("example.org."), now)
+	assert.Nil(t, err)
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+
+	assert.Equal(t, droppedEntries{TooOld: 1, NoQuestion: 1, EmptyHost: 2, TooLong: 2}, d.getDropped())
+	assert.Equal(t, 1, len(d.getStatsTop().Domains))
+}
+
+func TestTopClientsSeen(t *testing.T) {
+	d := createTestTop()
+	now := time.Now()
+	add := func(ip string, hoursAgo int) {
+		entry := &logEntry{Time: now.Add(-time.Duration(hoursAgo) * time.Hour), IP: ip}
+		err := d.addEntry(entry, createTestMessage("example.org."), now)
+		assert.Nil(t, err)
+	}
+	add("1.2.3.4", 3)
+	add("1.2.3.4", 0)
+	add("5.6.7.8", 1)
+
+	assert.Equal(t, map[string]ClientSeen{
+		"1.2.3.4": {FirstSeen: 3, LastSeen: 0},
+		"5.6.7.8": {FirstSeen: 1, LastSeen: 1},
+	}, d.getClientsSeen([]string{"1.2.3.4", "5.6.7.8", "9.9.9.9"}))
+}
+
+func TestTopBlockedByReason(t *testing.T) {
+	d := createTestTop()
+	now := time.Now()
+	add := func(host string, reason dnsfilter.Reason) {
+		entry := &logEntry{Time: now, Result: dnsfilter.Result{IsFiltered: true, Reason: reason}}
+		err := d.addEntry(entry, createTestMessage(host), now)
+		assert.Nil(t, err)
+	}
+	add("ads.example.org.", dnsfilter.FilteredBlackList)
+	add("ads.example.org.", dnsfilter.FilteredBlackList)
+	add("malware.example.org.", dnsfilter.FilteredSafeBrowsing)
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+
+	assert.Equal(t, map[string]int{"ads.example.org": 2}, d.getTopBlockedByReason(dnsfilter.FilteredBlackList))
+	assert.Equal(t, map[string]int{"malware.example.org": 1}, d.getTopBlockedByReason(dnsfilter.FilteredSafeBrowsing))
+	assert.Equal(t, map[string]int{}, d.getTopBlockedByReason(dnsfilter.FilteredParental))
+	assert.Equal(t, 2, len(d.getStatsTop().Blocked))
+}
+
+func TestTopDomainCount(t *testing.T) {
+	d := createTestTop()
+	now := time.Now()
+	entry := &logEntry{Time: now, Result: dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList}}
+	err := d.addEntry(entry, createTestMessage("ads.example.org."), now)
+	assert.Nil(t, err)
+	addTestTopEntry(t, d, "ads.example.org.", "1.2.3.4")
+	addTestTopEntry(t, d, "ads.example.org.", "1.2.3.4")
+
+	allowed, blocked := d.getDomainCount("Ads.Example.org.")
+	assert.Equal(t, 2, allowed)
+	assert.Equal(t, 1, blocked)
+
+	allowed, blocked = d.getDomainCount("absent.example.org")
+	assert.Equal(t, 0, allowed)
+	assert.Equal(t, 0, blocked)
+}
+
+func TestTopUniqueClients(t *testing.T) {
+	d := createTestTop()
+	for i := 0; i < queryLogTopSize+10; i++ {
+		addTestTopEntry(t, d, "example.org.", fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	addTestTopEntry(t, d, "example.org.", "10.0.0.1")
+	d.rotateHourlyTop()
+	addTestTopEntry(t, d, "example.org.", "10.0.0.1")
+	addTestTopEntry(t, d, "example.org.", "192.168.0.1")
+
+	total, hourly := d.getUniqueClients()
+	assert.Equal(t, queryLogTopSize+11, total)
+	assert.Equal(t, 24, len(hourly))
+	assert.Equal(t, queryLogTopSize+10, hourly[22])
+	assert.Equal(t, 2, hourly[23])
+}
+
+func TestTopUniqueDomains(t *testing.T) {
+	d := createTestTop()
+	now := time.Now()
+	add := func(host string, blocked bool) {
+		entry := &logEntry{Time: now, IP: "1.2.3.4"}
+		if blocked {
+			entry.Result = dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList}
+		}
+		err := d.addEntry(entry, createTestMessage(host), now)
+		assert.Nil(t, err)
+	}
+	for i := 0; i < queryLogTopSize+10; i++ {
+		add(fmt.Sprintf("host%d.example.org.", i), i%2 == 0)
+	}
+	d.rotateHourlyTop()
+	add("host0.example.org.", true)
+	add("example.com.", false)
+
+	total, hourly := d.getUniqueDomains()
+	assert.Equal(t, queryLogTopSize+11, total)
+	assert.Equal(t, queryLogTopSize+10, hourly[22])
+	assert.Equal(t, 2, hourly[23])
+
+	total, hourly = d.getUniqueBlockedDomains()
+	assert.Equal(t, (queryLogTopSize+10)/2, total)
+	assert.Equal(t, (queryLogTopSize+10)/2, hourly[22])
+	assert.Equal(t, 1, hourly[23])
+}
+
+func TestTopUniqueClientsLimit(t *testing.T) {
+	d := createTestTop()
+	for i := 0; i < queryLogTopMaxClients+10; i++ {
+		addTestTopEntry(t, d, "example.org.", fmt.Sprintf("10.%d.%d.%d", i/65536, i/256%256, i%256))
+	}
+	d.rotateHourlyTop()
+	addTestTopEntry(t, d, "example.org.", "192.168.0.1")
+
+	// the clients over the limit aren't remembered, but their requests are still counted
+	total, hourly := d.getUniqueClients()
+	assert.Equal(t, queryLogTopMaxClients+1, total)
+	assert.Equal(t, queryLogTopMaxClients, hourly[22])
+	assert.Equal(t, 1, hourly[23])
+	assert.Equal(t, queryLogTopMaxClients+11, d.getStatsTop().Domains["example.org"])
+}
+
+func TestTopBlockedLists(t *testing.T) {
+	d := createTestTop()
+	now := time.Now()
+	add := func(host string, reason dnsfilter.Reason, filterID int64) {
+		entry := &logEntry{Time: now, Result: dnsfilter.Result{IsFiltered: true, Reason: reason, FilterID: filterID}}
+		err := d.addEntry(entry, createTestMessage(host), now)
+		assert.Nil(t, err)
+	}
+	add("ads.example.org.", dnsfilter.FilteredBlackList, 1)
+	add("ads.example.org.", dnsfilter.FilteredBlackList, 1)
+	add("tracker.example.org.", dnsfilter.FilteredBlackList, 2)
+	add("custom.example.org.", dnsfilter.FilteredBlackList, 0)
+	add("malware.example.org.", dnsfilter.FilteredSafeBrowsing, 0)
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+
+	assert.Equal(t, map[string]int{"0": 1, "1": 2, "2": 1}, d.getStatsTop().Lists)
+}
+
+func TestTopForHour(t *testing.T) {
+	d := createTestTop()
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+	d.rotateHourlyTop()
+	addTestTopEntry(t, d, "example.org.", "5.6.7.8")
+
+	assert.Equal(t, map[string]int{"5.6.7.8": 1}, d.getStatsTopRange(0, 0).Clients)
+	assert.Equal(t, map[string]int{"1.2.3.4": 2}, d.getStatsTopRange(1, 1).Clients)
+	assert.Equal(t, map[string]int{}, d.getStatsTopRange(2, 2).Clients)
+	assert.Equal(t, map[string]int{"1.2.3.4": 2, "5.6.7.8": 1}, d.getStatsTop().Clients)
+}
+
+func TestTopClear(t *testing.T) {
+	d := createTestTop()
+	now := time.Now()
+	err := d.addEntry(&logEntry{Time: now}, &dns.Msg{}, now)
+	assert.Nil(t, err)
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+	d.rotateHourlyTop()
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+
+	d.clear()
+	top := d.getStatsTop()
+	assert.Equal(t, 0, len(top.Domains))
+	assert.Equal(t, 0, len(top.Clients))
+	assert.Equal(t, 24, len(d.hours))
+	assert.Equal(t, droppedEntries{NoQuestion: 1}, d.getDropped())
+	unique, hourly := d.getUniqueClients()
+	assert.Equal(t, 1, unique)
+	assert.Equal(t, []int{1, 1}, hourly[:2])
+	unique, _ = d.getUniqueDomains()
+	assert.Equal(t, 1, unique)
+
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+	assert.Equal(t, 1, d.getStatsTop().Domains["example.org"])
+}
+
+func TestTopDomainsForClient(t *testing.T) {
+	d := createTestTop()
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+	addTestTopEntry(t, d, "example.com.", "1.2.3.4")
+	addTestTopEntry(t, d, "example.net.", "1.2.3.45")
+	addTestTopEntry(t, d, "example.net.", "")
+
+	assert.Equal(t, map[string]int{"example.org": 2, "example.com": 1}, d.getTopDomainsForClient("1.2.3.4"))
+	assert.Equal(t, map[string]int{"example.net": 1}, d.getTopDomainsForClient("1.2.3.45"))
+	assert.Equal(t, map[string]int{}, d.getTopDomainsForClient("5.6.7.8"))
+}
+
+func TestTopDetailedClients(t *testing.T) {
+	d := createTestTop()
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+	addTestTopEntry(t, d, "example.org.", "5.6.7.8")
+
+	d.setConfig(newTopConfig(&ServerConfig{FilteringConfig: FilteringConfig{StatsDetailedClients: []string{"1.2.3.4"}}}))
+	addTestTopEntry(t, d, "example.com.", "1.2.3.4")
+	addTestTopEntry(t, d, "example.com.", "5.6.7.8")
+
+	assert.Equal(t, map[string]int{"example.org": 1, "example.com": 1}, d.getTopDomainsForClient("1.2.3.4"))
+	assert.Equal(t, map[string]int{}, d.getTopDomainsForClient("5.6.7.8"))
+	assert.Equal(t, map[string]int{"1.2.3.4": 2, "5.6.7.8": 2}, d.getStatsTop().Clients)
+	assert.Equal(t, map[string]int{"example.org": 2, "example.com": 2}, d.getStatsTop().Domains)
+}
+
+func TestTopMemEstimate(t *testing.T) {
+	d := createTestTop()
+	empty := d.memEstimate()
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+	one := d.memEstimate()
+	assert.True(t, one > empty)
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+	assert.Equal(t, one, d.memEstimate())
+	addTestTopEntry(t, d, "example.com.", "5.6.7.8")
+	assert.True(t, d.memEstimate() > one)
+}
+
+func TestTopDomainsForClientLimits(t *testing.T) {
+	d := createTestTop()
+	addTestTopEntry(t, d, "example.org.", "1.2.3.4")
+	for i := 0; i < queryLogTopClientDomains+10; i++ {
+		addTestTopEntry(t, d, fmt.Sprintf("host%d.example.com.", i), "5.6.7.8")
+	}
+	assert.Equal(t, map[string]int{"example.org": 1}, d.getTopDomainsForClient("1.2.3.4"))
+	assert.Equal(t, queryLogTopClientDomains, len(d.getTopDomainsForClient("5.6.7.8")))
+
+	for i := 0; i < queryLogTopDetailedClients; i++ {
+		addTestTopEntry(t, d, "example.net.", fmt.Sprintf("10.0.0.%d", i))
+	}
+	assert.Equal(t, map[string]int{"example.net": 1}, d.getTopDomainsForClient("10.0.0.0"))
+	assert.Equal(t, map[string]int{}, d.getTopDomainsForClient(fmt.Sprintf("10.0.0.%d", queryLogTopDetailedClients-1)))
+	assert.Equal(t, 1, d.getStatsTop().Clients[fmt.Sprintf("10.0.0.%d", queryLogTopDetailedClients-1)])
+}
+
+func TestTopDetailedDomains(t *testing.T) {
+	top := StatsTop{
+		Domains: map[string]int{"both.org": 5, "allowed.org": 3, "blocked.org": 4, "tie.org": 4},
+		Blocked: map[string]int{"both.org": 2, "blocked.org": 4},
+	}
+	assert.Equal(t, []DomainStats{
+		{Name: "both.org", Allowed: 3, Blocked: 2},
+		{Name: "blocked.org", Allowed: 0, Blocked: 4},
+		{Name: "tie.org", Allowed: 4, Blocked: 0},
+	}, top.DetailedDomains(3))
+}
+
+func TestTopDetailedClients(t *testing.T) {
+	d := createTestTop()
+	now := time.Now()
+	add := func(ip string, blocked bool) {
+		entry := &logEntry{Time: now, IP: ip}
+		if blocked {
+			entry.Result = dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList}
+		}
+		err := d.addEntry(entry, createTestMessage("example.org."), now)
+		assert.Nil(t, err)
+	}
+	add("1.2.3.4", true)
+	add("1.2.3.4", false)
+	add("1.2.3.4", false)
+	add("1.2.3.4", true)
+	add("5.6.7.8", false)
+
+	assert.Equal(t, []ClientStats{
+		{IP: "1.2.3.4", Total: 4, Blocked: 2, Ratio: 0.5},
+		{IP: "5.6.7.8", Total: 1, Blocked: 0, Ratio: 0},
+	}, d.getStatsTop().DetailedClients(10))
+
+	top := StatsTop{Clients: map[string]int{"1.2.3.4": 0}, BlockedClients: map[string]int{"1.2.3.4": 1}}
+	assert.Equal(t, []ClientStats{{IP: "1.2.3.4"}}, top.DetailedClients(10))
+}
+
+func TestTopClientsTime(t *testing.T) {
+	d := createTestTop()
+	now := time.Now()
+	add := func(ip string, elapsed time.Duration) {
+		entry := &logEntry{Time: now, IP: ip, Elapsed: elapsed}
+		err := d.addEntry(entry, createTestMessage("example.org."), now)
+		assert.Nil(t, err)
+	}
+	// many fast requests from one client, a few slow ones from another
+	for i := 0; i < 5; i++ {
+		add("1.2.3.4", time.Millisecond)
+	}
+	add("5.6.7.8", 100*time.Millisecond)
+	add("5.6.7.8", 50*time.Millisecond)
+
+	top := d.getStatsTop()
+	assert.Equal(t, map[string]int{"1.2.3.4": 5, "5.6.7.8": 2}, top.Clients)
+	assert.Equal(t, map[string]int{"1.2.3.4": 5000, "5.6.7.8": 150000}, top.ClientsTime)
+}
+
+func TestGroupClientsBySubnet(t *testing.T) {
+	top := map[string]int{
+		"192.168.1.10": 1,
+		"192.168.1.20": 2,
+		"192.168.2.10": 4,
+		"2001:db8::1":  8,
+		"2001:db8::2":  16,
+		"client-id":    32,
+	}
+	assert.Equal(t, map[string]int{
+		"192.168.1.0/24": 3,
+		"192.168.2.0/24": 4,
+		"2001:db8::1":    8,
+		"2001:db8::2":    16,
+		"client-id":      32,
+	}, groupClientsBySubnet(top, 24, 0))
+
+	assert.Equal(t, map[string]int{
+		"192.168.1.10":  1,
+		"192.168.1.20":  2,
+		"192.168.2.10":  4,
+		"2001:db8::/48": 24,
+		"client-id":     32,
+	}, groupClientsBySubnet(top, 32, 48))
+}
+
+func TestMergeIPv6PrivacyAddresses(t *testing.T) {
+	top := map[string]int{
+		"2001:db8:0:1:a::1": 1,
+		"2001:db8:0:1:b::2": 2,
+		"2001:db8:0:1:c::3": 4,
+		"2001:db8:0:2::1":   8,
+		"192.168.1.10":      16,
+	}
+
+	c := FilteringConfig{StatsClientsMergeIPv6: true}
+	ipv4PrefixLen, ipv6PrefixLen := c.clientsPrefixLens()
+	assert.Equal(t, 0, ipv4PrefixLen)
+	assert.Equal(t, 64, ipv6PrefixLen)
+	assert.Equal(t, map[string]int{
+		"2001:db8:0:1::/64": 7,
+		"2001:db8:0:2::/64": 8,
+		"192.168.1.10":      16,
+	}, groupClientsBySubnet(top, ipv4PrefixLen, ipv6PrefixLen))
+
+	// a shorter prefix length is kept, a longer one is shortened to /64
+	c.StatsClientsIPv6PrefixLen = 48
+	_, ipv6PrefixLen = c.clientsPrefixLens()
+	assert.Equal(t, 48, ipv6PrefixLen)
+	c.StatsClientsIPv6PrefixLen = 96
+	_, ipv6PrefixLen = c.clientsPrefixLens()
+	assert.Equal(t, 64, ipv6PrefixLen)
+
+	c.StatsClientsMergeIPv6 = false
+	_, ipv6PrefixLen = c.clientsPrefixLens()
+	assert.Equal(t, 96, ipv6PrefixLen)
+}
@@ -2,6 +2,7 @@ package dnsforward
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -11,6 +12,16 @@ import (
 // how far back to keep the stats
 const statsHistoryElements = 60 + 1 // +1 for calculating delta
 
+// forecastMaxHorizon is how many hours ahead the number of requests can be forecast
+const forecastMaxHorizon = 24
+
+// qpsSeconds is how many last complete seconds the current number of queries per second is averaged over
+const qpsSeconds = 10
+
+// statsSchemaVersion is the version of the stats responses structure
+// it's increased when fields are removed or their meaning changes, not when new fields are added
+const statsSchemaVersion = 1
+
 // entries for single time period (for example all per-second entries)
 type statsEntries map[string][statsHistoryElements]float64
 
@@ -38,6 +49,8 @@ type stats struct {
 	whitelisted          *counter   // total number of requests whitelisted by filter lists
 	safesearch           *counter   // total number of requests for which safe search rules were applied
 	errorsTotal          *counter   // total number of errors
+	cacheHits            *counter   // total number of requests answered from the cache
+	cacheMisses          *counter   // total number of requests sent to an upstream server
 	elapsedTime          *histogram // requests duration histogram
 }
 
@@ -52,6 +65,8 @@ func newStats() *stats {
 		whitelisted:          newDNSCounter("whitelisted_total"),
 		safesearch:           newDNSCounter("safesearch_total"),
 		errorsTotal:          newDNSCounter("errors_total"),
+		cacheHits:            newDNSCounter("cache_hits_total"),
+		cacheMisses:          newDNSCounter("cache_misses_total"),
 		elapsedTime:          newDNSHistogram("request_duration"),
 	}
 
@@ -75,28 +90,45 @@ func (s *stats) purgeStats() {
 	initPeriodicStats(&s.perDay, time.Hour*24)
 }
 
-func (p *periodicStats) Inc(name string, when time.Time) {
-	// calculate how many periods ago this happened
-	elapsed := int64(time.Since(when) / p.period)
-	// log.Tracef("%s: %v as %v -> [%v]", name, time.Since(when), p.period, elapsed)
+// periodsAgo returns how many periods ago the time was, false if it's outside of our timeframe
+// must be called with the lock held: the period is changed by purgeStats()
+func (p *periodicStats) periodsAgo(when time.Time) (int64, bool) {
+	elapsed := periodIndex(p.lastRotate, p.period, when)
+	// log.Tracef("%v as %v -> [%v]", when, p.lastRotate, elapsed)
 	if elapsed >= statsHistoryElements {
-		return // outside of our timeframe
+		return 0, false
 	}
+	return elapsed, true
+}
+
+// periodIndex returns the index of the period the time belongs to, the current period 0 began at lastRotate
+// and period i began at lastRotate-i*period
+func periodIndex(lastRotate time.Time, period time.Duration, when time.Time) int64 {
+	if !when.Before(lastRotate) {
+		return 0 // the clock went backward or the rotation is late, count it in the current period
+	}
+	return int64((lastRotate.Sub(when)-1)/period) + 1
+}
+
+func (p *periodicStats) Inc(name string, when time.Time) {
 	p.Lock()
+	defer p.Unlock()
+	elapsed, ok := p.periodsAgo(when)
+	if !ok {
+		return // outside of our timeframe
+	}
 	currentValues := p.entries[name]
 	currentValues[elapsed]++
 	p.entries[name] = currentValues
-	p.Unlock()
 }
 
 func (p *periodicStats) Observe(name string, when time.Time, value float64) {
-	// calculate how many periods ago this happened
-	elapsed := int64(time.Since(when) / p.period)
-	// log.Tracef("%s: %v as %v -> [%v]", name, time.Since(when), p.period, elapsed)
-	if elapsed >= statsHistoryElements {
+	p.Lock()
+	defer p.Unlock()
+	elapsed, ok := p.periodsAgo(when)
+	if !ok {
 		return // outside of our timeframe
 	}
-	p.Lock()
 	{
 		countname := name + "_count"
 		currentValues := p.entries[countname]
@@ -112,12 +144,48 @@ func (p *periodicStats) Observe(name string, when time.Time, value float64) {
 		currentValues[elapsed] += value
 		p.entries[totalname] = currentValues
 	}
-	p.Unlock()
+}
+
+// snapshot returns a copy of the current entries
+// the lock is held only while copying so that readers don't stall the DNS requests processing
+func (p *periodicStats) snapshot() statsEntries {
+	entries, _ := p.snapshotAt()
+	return entries
+}
+
+// snapshotAt returns a copy of the current entries and the beginning of the current period
+func (p *periodicStats) snapshotAt() (statsEntries, time.Time) {
+	p.RLock()
+	entries := make(statsEntries, len(p.entries))
+	for name, values := range p.entries {
+		entries[name] = values
+	}
+	lastRotate := p.lastRotate
+	p.RUnlock()
+	return entries, lastRotate
+}
+
+// sum returns the sum of the named entry for the last numPeriods periods without copying all the entries
+func (p *periodicStats) sum(name string, numPeriods int) float64 {
+	return p.sumRange(name, 0, numPeriods-1)
+}
+
+// sumRange returns the sum of the named entry from first to last periods ago, both inclusive
+func (p *periodicStats) sumRange(name string, first, last int) float64 {
+	p.RLock()
+	defer p.RUnlock()
+	values := p.entries[name]
+	sum := 0.0
+	for i := clamp(first, 0, statsHistoryElements); i <= last && i < statsHistoryElements; i++ {
+		sum += values[i]
+	}
+	return sum
 }
 
 func (p *periodicStats) statsRotate(now time.Time) {
 	p.Lock()
-	rotations := int64(now.Sub(p.lastRotate) / p.period)
+	elapsed := int64(now.Sub(p.lastRotate) / p.period)
+	rotations := elapsed
 	if rotations > statsHistoryElements {
 		rotations = statsHistoryElements
 	}
@@ -132,13 +200,22 @@ func (p *periodicStats) statsRotate(now time.Time) {
 		}
 	}
 	if rotations > 0 {
-		p.lastRotate = now
+		// keep the periods boundaries, so that the values can be labeled with their time
+		p.lastRotate = p.lastRotate.Add(time.Duration(elapsed) * p.period)
 	}
 	p.Unlock()
 }
 
-func (s *stats) statsRotator() {
-	for range time.Tick(time.Second) {
+func (s *stats) statsRotator(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
 		now := time.Now()
 		s.perSecond.statsRotate(now)
 		s.perMinute.statsRotate(now)
@@ -197,11 +274,65 @@ func (s *stats) observeWithTime(h *histogram, value float64, when time.Time) {
 	h.Unlock()
 }
 
+// reasonEntryName returns the name of the periodic stats entry that counts requests with the specified reason
+func reasonEntryName(reason dnsfilter.Reason) string {
+	return "reason_" + strconv.Itoa(int(reason))
+}
+
+// statsTransports are the protocols requests are counted by, as in proxy.DNSContext.Proto
+// requests received over other protocols are only counted in the totals
+var statsTransports = []string{"udp", "tcp", "tls", "https"}
+
+// transportEntryName returns the name of the periodic stats entry that counts requests received over the protocol
+func transportEntryName(proto string) string {
+	return "transport_" + proto
+}
+
+// processingTimeBounds are the upper bounds of the processing time histogram buckets
+// the last bucket counts the requests that took longer than the last bound
+var processingTimeBounds = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second,
+}
+
+// processingTimeEntryName returns the name of the periodic stats entry for the processing time histogram bucket
+func processingTimeEntryName(bucket int) string {
+	return "processing_time_bucket_" + strconv.Itoa(bucket)
+}
+
+// processingTimeBucket returns the index of the histogram bucket for the processing time
+func processingTimeBucket(elapsed time.Duration) int {
+	for i, bound := range processingTimeBounds {
+		if elapsed < bound {
+			return i
+		}
+	}
+	return len(processingTimeBounds)
+}
+
+// incNameWithTime increments the periodic stats entry that has no counter
+func (s *stats) incNameWithTime(name string, when time.Time) {
+	s.perSecond.Inc(name, when)
+	s.perMinute.Inc(name, when)
+	s.perHour.Inc(name, when)
+	s.perDay.Inc(name, when)
+}
+
 // -----
 // stats
 // -----
 func (s *stats) incrementCounters(entry *logEntry) {
 	s.incWithTime(s.requests, entry.Time)
+	s.incNameWithTime(reasonEntryName(entry.Result.Reason), entry.Time)
+	s.incNameWithTime(processingTimeEntryName(processingTimeBucket(entry.Elapsed)), entry.Time)
+	for _, proto := range statsTransports {
+		if entry.Proto == proto {
+			s.incNameWithTime(transportEntryName(proto), entry.Time)
+			break
+		}
+	}
 	if entry.Result.IsFiltered {
 		s.incWithTime(s.filtered, entry.Time)
 	}
@@ -222,50 +353,184 @@ func (s *stats) incrementCounters(entry *logEntry) {
 	case dnsfilter.FilteredSafeSearch:
 		s.incWithTime(s.safesearch, entry.Time)
 	}
+
+	// a request that was resolved without an upstream server was answered from the cache
+	if entry.Upstream != "" {
+		s.incWithTime(s.cacheMisses, entry.Time)
+	} else if !entry.Result.IsFiltered && len(entry.Result.IPList) == 0 {
+		s.incWithTime(s.cacheHits, entry.Time)
+	}
 	s.observeWithTime(s.elapsedTime, entry.Elapsed.Seconds(), entry.Time)
 }
 
+// StatsResult is the stats data aggregated over a number of hours
+type StatsResult struct {
+	DNSQueries              float64            `json:"dns_queries"`
+	BlockedFiltering        float64            `json:"blocked_filtering"`
+	BlockedPercentage       float64            `json:"blocked_percentage"`
+	ReplacedSafebrowsing    float64            `json:"replaced_safebrowsing"`
+	ReplacedSafesearch      float64            `json:"replaced_safesearch"`
+	ReplacedParental        float64            `json:"replaced_parental"`
+	AvgProcessingTime       float64            `json:"avg_processing_time"` // milliseconds
+	CacheHits               float64            `json:"cache_hits"`
+	CacheMisses             float64            `json:"cache_misses"`
+	CacheHitRatio           float64            `json:"cache_hit_ratio"`
+	ResultReasons           []ReasonCount      `json:"result_reasons"`
+	QueryTransports         map[string]float64 `json:"query_transports"`
+	ProcessingTimeHistogram []HistogramBucket  `json:"processing_time_histogram"`
+	LatencyP50              float64            `json:"latency_p50"` // milliseconds
+	LatencyP95              float64            `json:"latency_p95"` // milliseconds
+	LatencyP99              float64            `json:"latency_p99"` // milliseconds
+	OldestDataTime          string             `json:"oldest_data_time,omitempty"`
+	StatsPeriod             string             `json:"stats_period"`
+	SchemaVersion           int                `json:"schema_version"`
+}
+
+// ReasonCount is the number of requests with the specified filtering result reason
+type ReasonCount struct {
+	ID    int     `json:"id"`
+	Name  string  `json:"name"`
+	Count float64 `json:"count"`
+}
+
+// HistogramBucket is the number of requests processed in up to UpperBoundMs milliseconds
+// the last bucket has no upper bound
+type HistogramBucket struct {
+	UpperBoundMs float64 `json:"upper_bound_ms,omitempty"`
+	Count        float64 `json:"count"`
+}
+
 // getAggregatedStats returns aggregated stats data for the 24 hours
-func (s *stats) getAggregatedStats() map[string]interface{} {
-	const numHours = 24
-	historical := s.generateMapFromStats(&s.perHour, 0, numHours)
+func (s *stats) getAggregatedStats() StatsResult {
+	summed := s.aggregateHours(24)
+	summed.StatsPeriod = "24 hours"
+	return summed
+}
+
+// getTotalBlocked returns the number of blocked requests for the last 24 hours
+func (s *stats) getTotalBlocked() uint64 {
+	return uint64(s.perHour.sum(s.filtered.name, 24))
+}
+
+// getTotalQueries returns the number of requests from first to last hours ago, both inclusive
+func (s *stats) getTotalQueries(first, last int) uint64 {
+	return uint64(s.perHour.sumRange(s.requests.name, first, last))
+}
+
+// getStatsToday returns stats data aggregated since the midnight in the specified location
+// stats are kept with an hour precision, so the oldest hour may begin before the midnight
+func (s *stats) getStatsToday(now time.Time, loc *time.Location) StatsResult {
+	local := now.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	summed := s.aggregateHours(int(now.Sub(midnight)/time.Hour) + 1)
+	summed.StatsPeriod = "today"
+	return summed
+}
+
+// aggregateHours returns stats data aggregated for the last numHours hours
+func (s *stats) aggregateHours(numHours int) StatsResult {
+	// a single snapshot, so that the totals and the values derived from them are consistent
+	entries, lastRotate := s.perHour.snapshotAt()
+	historical := s.generateMapFromEntries(entries, 0, numHours-1)
 	// sum them up
-	summed := map[string]interface{}{}
-	for key, values := range historical {
+	sum := func(key string) float64 {
 		summedValue := 0.0
-		floats, ok := values.([]float64)
-		if !ok {
-			continue
-		}
+		floats, _ := historical[key].([]float64)
 		for _, v := range floats {
 			summedValue += v
 		}
-		summed[key] = summedValue
+		return summedValue
+	}
+
+	summed := StatsResult{
+		DNSQueries:           sum("dns_queries"),
+		BlockedFiltering:     sum("blocked_filtering"),
+		ReplacedSafebrowsing: sum("replaced_safebrowsing"),
+		ReplacedSafesearch:   sum("replaced_safesearch"),
+		ReplacedParental:     sum("replaced_parental"),
+		CacheHits:            sum("cache_hits"),
+		CacheMisses:          sum("cache_misses"),
+		SchemaVersion:        statsSchemaVersion,
+	}
+
+	// the sum of hourly averages is meaningless, calculate the average over all requests instead
+	count := sumSlice(getReversedSlice(entries[s.elapsedTime.name+"_count"], 0, numHours-1))
+	if count != 0 {
+		total := sumSlice(getReversedSlice(entries[s.elapsedTime.name+"_sum"], 0, numHours-1))
+		summed.AvgProcessingTime = total / count * 1000
 	}
-	// don't forget to divide by number of elements in returned slice
-	if val, ok := summed["avg_processing_time"]; ok {
-		if flval, flok := val.(float64); flok {
-			flval /= numHours
-			summed["avg_processing_time"] = flval
+
+	// all known reasons are listed, so that new ones appear without changes in the API handlers
+	summed.ResultReasons = []ReasonCount{}
+	for _, reason := range dnsfilter.Reasons {
+		summed.ResultReasons = append(summed.ResultReasons, ReasonCount{
+			ID:    int(reason),
+			Name:  reason.String(),
+			Count: sumSlice(getReversedSlice(entries[reasonEntryName(reason)], 0, numHours-1)),
+		})
+	}
+
+	summed.QueryTransports = map[string]float64{}
+	for _, proto := range statsTransports {
+		summed.QueryTransports[proto] = sumSlice(getReversedSlice(entries[transportEntryName(proto)], 0, numHours-1))
+	}
+
+	summed.ProcessingTimeHistogram = []HistogramBucket{}
+	boundsMs := make([]float64, len(processingTimeBounds))
+	counts := make([]float64, len(processingTimeBounds)+1)
+	for i := 0; i <= len(processingTimeBounds); i++ {
+		counts[i] = sumSlice(getReversedSlice(entries[processingTimeEntryName(i)], 0, numHours-1))
+		bucket := HistogramBucket{
+			Count: counts[i],
 		}
+		if i < len(processingTimeBounds) {
+			boundsMs[i] = float64(processingTimeBounds[i]) / float64(time.Millisecond)
+			bucket.UpperBoundMs = boundsMs[i]
+		}
+		summed.ProcessingTimeHistogram = append(summed.ProcessingTimeHistogram, bucket)
 	}
+	summed.LatencyP50 = histogramPercentile(boundsMs, counts, 0.50)
+	summed.LatencyP95 = histogramPercentile(boundsMs, counts, 0.95)
+	summed.LatencyP99 = histogramPercentile(boundsMs, counts, 0.99)
+
+	// percentages can't be summed up, calculate it from the totals
+	summed.BlockedPercentage = percentage(summed.BlockedFiltering, summed.DNSQueries)
+	summed.CacheHitRatio = cacheHitRatio(summed.CacheHits, summed.CacheMisses)
 
-	summed["stats_period"] = "24 hours"
+	oldest, ok := oldestTimestamp(entries[s.requests.name], numHours-1, lastRotate)
+	if ok {
+		summed.OldestDataTime = oldest.Format(time.RFC3339)
+	}
 	return summed
 }
 
+// oldestTimestamp returns the beginning of the oldest hour (not older than maxHour) with requests
+// lastRotate is the beginning of the current hour of the hourly stats
+func oldestTimestamp(requests [statsHistoryElements]float64, maxHour int, lastRotate time.Time) (time.Time, bool) {
+	for i := clamp(maxHour, 0, statsHistoryElements-1); i >= 0; i-- {
+		if requests[i] != 0 {
+			return lastRotate.Add(-time.Duration(i) * time.Hour), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// generateMapFromStats returns the values of periods [start..end] from oldest to newest,
+// where period 0 is the current one.  The result always has end-start+1 elements.
 func (s *stats) generateMapFromStats(stats *periodicStats, start int, end int) map[string]interface{} {
-	stats.RLock()
-	defer stats.RUnlock()
+	return s.generateMapFromEntries(stats.snapshot(), start, end)
+}
 
-	// clamp
-	start = clamp(start, 0, statsHistoryElements)
-	end = clamp(end, 0, statsHistoryElements)
+// generateMapFromEntries is generateMapFromStats for already taken snapshot of the periodic stats
+func (s *stats) generateMapFromEntries(entries statsEntries, start int, end int) map[string]interface{} {
+	// clamp, both start and end are inclusive indexes
+	start = clamp(start, 0, statsHistoryElements-1)
+	end = clamp(end, 0, statsHistoryElements-1)
 
 	avgProcessingTime := make([]float64, 0)
 
-	count := getReversedSlice(stats.entries[s.elapsedTime.name+"_count"], start, end)
-	sum := getReversedSlice(stats.entries[s.elapsedTime.name+"_sum"], start, end)
+	count := getReversedSlice(entries[s.elapsedTime.name+"_count"], start, end)
+	sum := getReversedSlice(entries[s.elapsedTime.name+"_sum"], start, end)
 	for i := 0; i < len(count); i++ {
 		var avg float64
 		if count[i] != 0 {
@@ -275,13 +540,161 @@ func (s *stats) generateMapFromStats(stats *periodicStats, start int, end int) m
 		avgProcessingTime = append(avgProcessingTime, avg)
 	}
 
+	requests := getReversedSlice(entries[s.requests.name], start, end)
+	filtered := getReversedSlice(entries[s.filtered.name], start, end)
+	blockedPercentage := make([]float64, 0)
+	for i := 0; i < len(requests); i++ {
+		blockedPercentage = append(blockedPercentage, percentage(filtered[i], requests[i]))
+	}
+
 	result := map[string]interface{}{
-		"dns_queries":           getReversedSlice(stats.entries[s.requests.name], start, end),
-		"blocked_filtering":     getReversedSlice(stats.entries[s.filtered.name], start, end),
-		"replaced_safebrowsing": getReversedSlice(stats.entries[s.filteredSafebrowsing.name], start, end),
-		"replaced_safesearch":   getReversedSlice(stats.entries[s.safesearch.name], start, end),
-		"replaced_parental":     getReversedSlice(stats.entries[s.filteredParental.name], start, end),
+		"dns_queries":           requests,
+		"blocked_filtering":     filtered,
+		"blocked_percentage":    blockedPercentage,
+		"replaced_safebrowsing": getReversedSlice(entries[s.filteredSafebrowsing.name], start, end),
+		"replaced_safesearch":   getReversedSlice(entries[s.safesearch.name], start, end),
+		"replaced_parental":     getReversedSlice(entries[s.filteredParental.name], start, end),
 		"avg_processing_time":   avgProcessingTime,
+		"cache_hits":            getReversedSlice(entries[s.cacheHits.name], start, end),
+		"cache_misses":          getReversedSlice(entries[s.cacheMisses.name], start, end),
+	}
+	return result
+}
+
+// StatsSnapshot is a lightweight summary of the stats sent to the subscribers
+type StatsSnapshot struct {
+	Time             time.Time `json:"time"`
+	DNSQueries       float64   `json:"dns_queries"`        // for the last 24 hours
+	BlockedFiltering float64   `json:"blocked_filtering"`  // for the last 24 hours
+	QueriesPerSecond float64   `json:"queries_per_second"` // averaged over the last qpsSeconds seconds
+}
+
+// getSnapshot returns the current stats summary
+func (s *stats) getSnapshot(now time.Time) StatsSnapshot {
+	return StatsSnapshot{
+		Time:             now,
+		DNSQueries:       s.perHour.sum(s.requests.name, 24),
+		BlockedFiltering: s.perHour.sum(s.filtered.name, 24),
+		// the current second isn't over yet and isn't used
+		QueriesPerSecond: s.perSecond.sumRange(s.requests.name, 1, qpsSeconds) / qpsSeconds,
+	}
+}
+
+// getForecast returns the expected number of requests for each of the next horizon hours
+func (s *stats) getForecast(horizon int) []float64 {
+	requests := s.perHour.snapshot()[s.requests.name]
+	return forecast(requests, horizon)
+}
+
+// forecast returns the expected hourly values for each of the next horizon (up to forecastMaxHorizon) hours,
+// every hour is forecast as the average of the same hour of the previous days
+// the history begins with the oldest hour with requests, if it's too short the result has fewer values
+func forecast(requests [statsHistoryElements]float64, horizon int) []float64 {
+	horizon = clamp(horizon, 0, forecastMaxHorizon)
+	oldest := 0
+	for i := statsHistoryElements - 1; i > 0; i-- {
+		if requests[i] != 0 {
+			oldest = i
+			break
+		}
+	}
+
+	result := []float64{}
+	for h := 1; h <= horizon; h++ {
+		sum, days := 0.0, 0
+		// the current hour isn't over yet and isn't used
+		for i := 24 - h; i <= oldest; i += 24 {
+			if i > 0 {
+				sum += requests[i]
+				days++
+			}
+		}
+		if days == 0 {
+			break
+		}
+		result = append(result, sum/float64(days))
+	}
+	return result
+}
+
+// histogramPercentile estimates the p-th (0..1) percentile from the histogram bucket counts
+// the value is interpolated linearly inside the bucket, the values in the last (unbounded) bucket
+// are estimated as the last bound; 0 is returned if there are no values
+func histogramPercentile(bounds []float64, counts []float64, p float64) float64 {
+	total := sumSlice(counts)
+	if total == 0 || len(bounds) == 0 {
+		return 0
+	}
+
+	rank := p * total
+	cumulative := 0.0
+	for i, count := range counts {
+		if count == 0 || cumulative+count < rank {
+			cumulative += count
+			continue
+		}
+		if i >= len(bounds) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = bounds[i-1]
+		}
+		return lower + (bounds[i]-lower)*(rank-cumulative)/count
+	}
+	return bounds[len(bounds)-1]
+}
+
+// percentage returns part as a percentage of total, 0 if total is 0
+func percentage(part, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return part / total * 100
+}
+
+// cacheHitRatio returns the share of requests answered from the cache, 0 if there were no requests
+func cacheHitRatio(hits, misses float64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return hits / (hits + misses)
+}
+
+// queriesPerClient returns the average number of requests per client, 0 if there were no clients
+func queriesPerClient(requests float64, clients int) float64 {
+	if clients == 0 {
+		return 0
+	}
+	return requests / float64(clients)
+}
+
+// getMovingAverage returns the number of requests per hour for the last 24 hours
+// smoothed with a trailing moving average over the specified number of hours
+func (s *stats) getMovingAverage(window int) []float64 {
+	entries := s.perHour.snapshot()
+	return movingAverage(getReversedSlice(entries[s.requests.name], 0, 23), window)
+}
+
+// movingAverage returns a trailing moving average of the series
+// points with less than window predecessors are averaged over what exists
+// if window <= 0, a copy of the series is returned
+func movingAverage(series []float64, window int) []float64 {
+	result := make([]float64, len(series))
+	if window <= 0 {
+		copy(result, series)
+		return result
+	}
+
+	sum := 0.0
+	for i, v := range series {
+		sum += v
+		n := i + 1
+		if n > window {
+			sum -= series[i-window]
+			n = window
+		}
+		result[i] = sum / float64(n)
 	}
 	return result
 }
@@ -292,19 +705,7 @@ func (s *stats) generateMapFromStats(stats *periodicStats, start int, end int) m
 // end is end of the time range
 // returns nil if time unit is not supported
 func (s *stats) getStatsHistory(timeUnit time.Duration, startTime time.Time, endTime time.Time) (map[string]interface{}, error) {
-	var stats *periodicStats
-
-	switch timeUnit {
-	case time.Second:
-		stats = &s.perSecond
-	case time.Minute:
-		stats = &s.perMinute
-	case time.Hour:
-		stats = &s.perHour
-	case 24 * time.Hour:
-		stats = &s.perDay
-	}
-
+	stats := s.periodicStatsFor(timeUnit)
 	if stats == nil {
 		return nil, fmt.Errorf("unsupported time unit: %v", timeUnit)
 	}
@@ -320,17 +721,113 @@ func (s *stats) getStatsHistory(timeUnit time.Duration, startTime time.Time, end
 		return nil, fmt.Errorf("end_time parameter is outside of supported range: %s", startTime.String())
 	}
 
+	// the labels must match the values, take them from the same snapshot
+	entries, lastRotate := stats.snapshotAt()
+
 	// calculate start and end of our array
-	// basically it's how many hours/minutes/etc have passed since now
-	start := int(now.Sub(endTime) / timeUnit)
-	end := int(now.Sub(startTime) / timeUnit)
+	// basically it's how many hours/minutes/etc have passed since the beginning of the current period
+	start := int(periodIndex(lastRotate, timeUnit, endTime))
+	end := int(periodIndex(lastRotate, timeUnit, startTime))
 
 	// swap them around if they're inverted
 	if start > end {
 		start, end = end, start
 	}
 
-	return s.generateMapFromStats(stats, start, end), nil
+	return s.historyFromEntries(entries, lastRotate, timeUnit, start, end), nil
+}
+
+// periodicStatsFor returns the periodic stats for the time unit, nil if the time unit is not supported
+func (s *stats) periodicStatsFor(timeUnit time.Duration) *periodicStats {
+	switch timeUnit {
+	case time.Second:
+		return &s.perSecond
+	case time.Minute:
+		return &s.perMinute
+	case time.Hour:
+		return &s.perHour
+	case 24 * time.Hour:
+		return &s.perDay
+	}
+	return nil
+}
+
+// StatsRow is the stats data for a single period
+type StatsRow struct {
+	Time         string  `json:"time"` // beginning of the period
+	Total        float64 `json:"total"`
+	Blocked      float64 `json:"blocked"`
+	Safebrowsing float64 `json:"safebrowsing"`
+	Parental     float64 `json:"parental"`
+	AvgTime      float64 `json:"avg_time"` // milliseconds
+}
+
+// getTable returns the stats data of every period of the time unit as rows, from oldest to newest
+func (s *stats) getTable(timeUnit time.Duration) ([]StatsRow, error) {
+	stats := s.periodicStatsFor(timeUnit)
+	if stats == nil {
+		return nil, fmt.Errorf("unsupported time unit: %v", timeUnit)
+	}
+	entries, lastRotate := stats.snapshotAt()
+	return historyRows(s.historyFromEntries(entries, lastRotate, timeUnit, 0, statsHistoryElements-1)), nil
+}
+
+// historyRows converts the series of a stats history to rows, one per period
+func historyRows(history map[string]interface{}) []StatsRow {
+	labels, _ := history["time_labels"].([]string)
+	value := func(name string, i int) float64 {
+		values, _ := history[name].([]float64)
+		if i >= len(values) {
+			return 0
+		}
+		return values[i]
+	}
+
+	rows := make([]StatsRow, 0, len(labels))
+	for i, label := range labels {
+		rows = append(rows, StatsRow{
+			Time:         label,
+			Total:        value("dns_queries", i),
+			Blocked:      value("blocked_filtering", i),
+			Safebrowsing: value("replaced_safebrowsing", i),
+			Parental:     value("replaced_parental", i),
+			AvgTime:      value("avg_processing_time", i),
+		})
+	}
+	return rows
+}
+
+// getHourlyDailyHistory returns the stats history for the last numHours hours and for the last numDays days
+// in the same format as getStatsHistory, under the "hourly" and "daily" keys
+func (s *stats) getHourlyDailyHistory(numHours, numDays int) map[string]interface{} {
+	hourly, hourlyRotate := s.perHour.snapshotAt()
+	daily, dailyRotate := s.perDay.snapshotAt()
+	return map[string]interface{}{
+		"hourly": s.historyFromEntries(hourly, hourlyRotate, time.Hour, 0, numHours-1),
+		"daily":  s.historyFromEntries(daily, dailyRotate, 24*time.Hour, 0, numDays-1),
+	}
+}
+
+// historyFromEntries returns the values of periods [start..end] of a snapshot along with their time labels
+func (s *stats) historyFromEntries(entries statsEntries, lastRotate time.Time, period time.Duration, start, end int) map[string]interface{} {
+	result := s.generateMapFromEntries(entries, start, end)
+	result["time_labels"] = timeLabels(lastRotate, period, start, end)
+	return result
+}
+
+// timeLabels returns the start time of every period from end to start periods ago,
+// in the same order as the values returned by generateMapFromStats
+// lastRotate is the beginning of the current period
+func timeLabels(lastRotate time.Time, period time.Duration, start int, end int) []string {
+	start = clamp(start, 0, statsHistoryElements-1)
+	end = clamp(end, 0, statsHistoryElements-1)
+
+	labels := make([]string, 0)
+	for i := end; i >= start; i-- {
+		t := lastRotate.Add(-time.Duration(i) * period)
+		labels = append(labels, t.Local().Format(time.RFC3339))
+	}
+	return labels
 }
 
 func clamp(value, low, high int) int {
@@ -346,6 +843,14 @@ func clamp(value, low, high int) int {
 // --------------------------
 // helper functions for stats
 // --------------------------
+func sumSlice(input []float64) float64 {
+	sum := 0.0
+	for _, v := range input {
+		sum += v
+	}
+	return sum
+}
+
 func getReversedSlice(input [statsHistoryElements]float64, start int, end int) []float64 {
 	output := make([]float64, 0)
 	for i := start; i <= end; i++ {
@@ -0,0 +1,522 @@
+package dnsforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsAggregatedWindow(t *testing.T) {
+	s := newStats()
+	now := time.Now()
+
+	// one request in each of the last 30 hours
+	for i := 0; i < 30; i++ {
+		s.perHour.Inc(s.requests.name, now.Add(-time.Duration(i)*time.Hour))
+	}
+	assert.Equal(t, 24.0, s.getAggregatedStats().DNSQueries)
+
+	m := s.generateMapFromStats(&s.perHour, 0, 23)
+	assert.Equal(t, 24, len(m["dns_queries"].([]float64)))
+
+	// the current hour has already been rotated: the oldest hour falls out of the window
+	s.perHour.statsRotate(s.perHour.lastRotate.Add(time.Hour))
+	assert.Equal(t, 23.0, s.getAggregatedStats().DNSQueries)
+
+	// out-of-range indexes are clamped
+	m = s.generateMapFromStats(&s.perHour, -5, statsHistoryElements+5)
+	assert.Equal(t, statsHistoryElements, len(m["dns_queries"].([]float64)))
+}
+
+func TestStatsTimeLabels(t *testing.T) {
+	s := newStats()
+	lastRotate := s.perHour.lastRotate
+	label := func(t time.Time) string {
+		return t.Local().Format(time.RFC3339)
+	}
+
+	assert.Equal(t, []string{
+		label(lastRotate.Add(-2 * time.Hour)),
+		label(lastRotate.Add(-1 * time.Hour)),
+		label(lastRotate),
+	}, timeLabels(lastRotate, time.Hour, 0, 2))
+	assert.Equal(t, []string{
+		label(lastRotate.Add(-2 * 24 * time.Hour)),
+		label(lastRotate.Add(-1 * 24 * time.Hour)),
+	}, timeLabels(lastRotate, 24*time.Hour, 1, 2))
+
+	// requests right at and right before the periods boundaries
+	s.perHour.Inc(s.requests.name, lastRotate)
+	s.perHour.Inc(s.requests.name, lastRotate.Add(-time.Nanosecond))
+	s.perHour.Inc(s.requests.name, lastRotate.Add(-time.Hour))
+	s.perHour.Inc(s.requests.name, lastRotate.Add(-time.Hour-time.Nanosecond))
+
+	// a late rotation keeps the boundaries
+	s.perHour.statsRotate(lastRotate.Add(time.Hour + 30*time.Minute))
+	assert.Equal(t, lastRotate.Add(time.Hour), s.perHour.lastRotate)
+
+	// every value is labeled with the beginning of the period its requests were made in
+	m, err := s.getStatsHistory(time.Hour, lastRotate.Add(-2*time.Hour), lastRotate.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{1, 2, 1, 0}, m["dns_queries"])
+	assert.Equal(t, []string{
+		label(lastRotate.Add(-2 * time.Hour)),
+		label(lastRotate.Add(-time.Hour)),
+		label(lastRotate),
+		label(lastRotate.Add(time.Hour)),
+	}, m["time_labels"])
+}
+
+func TestStatsSchemaVersion(t *testing.T) {
+	s := newStats()
+	assert.Equal(t, 1, s.getAggregatedStats().SchemaVersion)
+	assert.Equal(t, 1, s.getStatsToday(time.Now(), time.Local).SchemaVersion)
+
+	// every history value is a series, the version isn't there
+	m, err := s.getStatsHistory(time.Hour, time.Now().Add(-time.Hour), time.Now())
+	assert.Nil(t, err)
+	_, ok := m["schema_version"]
+	assert.False(t, ok)
+}
+
+func TestStatsClockBackward(t *testing.T) {
+	s := newStats()
+
+	// an entry from the future is counted in the current period
+	s.perHour.Inc(s.requests.name, time.Now().Add(time.Hour))
+	s.perHour.Observe(s.elapsedTime.name, time.Now().Add(time.Hour), 0.5)
+	assert.Equal(t, 1.0, s.perHour.entries[s.requests.name][0])
+	assert.Equal(t, 1.0, s.perHour.entries[s.elapsedTime.name+"_count"][0])
+
+	// rotating to an earlier time does nothing
+	last := s.perHour.lastRotate
+	s.perHour.statsRotate(last.Add(-2 * time.Hour))
+	assert.Equal(t, 1.0, s.perHour.entries[s.requests.name][0])
+	assert.Equal(t, last, s.perHour.lastRotate)
+
+	// once the clock catches up, rotation resumes and nothing is lost
+	s.perHour.statsRotate(last.Add(-30 * time.Minute))
+	assert.Equal(t, 1.0, s.perHour.entries[s.requests.name][0])
+	s.perHour.statsRotate(last.Add(time.Hour))
+	assert.Equal(t, 0.0, s.perHour.entries[s.requests.name][0])
+	assert.Equal(t, 1.0, s.perHour.entries[s.requests.name][1])
+	assert.Equal(t, last.Add(time.Hour), s.perHour.lastRotate)
+}
+
+func TestStatsCacheHits(t *testing.T) {
+	s := newStats()
+	assert.Equal(t, 0.0, s.getAggregatedStats().CacheHitRatio)
+
+	now := time.Now()
+	s.incrementCounters(&logEntry{Time: now, Upstream: "8.8.8.8:53"})
+	s.incrementCounters(&logEntry{Time: now})
+	s.incrementCounters(&logEntry{Time: now})
+	s.incrementCounters(&logEntry{Time: now})
+	// filtered requests are neither hits nor misses
+	s.incrementCounters(&logEntry{Time: now, Result: dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList}})
+
+	summed := s.getAggregatedStats()
+	assert.Equal(t, 3.0, summed.CacheHits)
+	assert.Equal(t, 1.0, summed.CacheMisses)
+	assert.Equal(t, 0.75, summed.CacheHitRatio)
+}
+
+func TestStatsConcurrentReadWrite(t *testing.T) {
+	s := newStats()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			s.incrementCounters(&logEntry{Time: time.Now(), Elapsed: time.Millisecond})
+		}
+		close(done)
+	}()
+
+	for i := 0; i < 100; i++ {
+		_ = s.getAggregatedStats()
+	}
+	<-done
+	assert.Equal(t, 1000.0, s.getAggregatedStats().DNSQueries)
+}
+
+func BenchmarkStatsIncrementWithReader(b *testing.B) {
+	s := newStats()
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = s.getAggregatedStats()
+			}
+		}
+	}()
+
+	entry := &logEntry{Time: time.Now(), Elapsed: time.Millisecond}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.incrementCounters(entry)
+	}
+	b.StopTimer()
+	close(stop)
+}
+
+func TestStatsTotalQueries(t *testing.T) {
+	s := newStats()
+	now := time.Now()
+	for i := 0; i < 30; i++ {
+		s.perHour.Inc(s.requests.name, now.Add(-time.Duration(i)*time.Hour))
+	}
+	assert.Equal(t, uint64(24), s.getTotalQueries(0, 23))
+	assert.Equal(t, uint64(1), s.getTotalQueries(3, 3))
+	assert.Equal(t, uint64(0), s.getTotalQueries(statsHistoryElements, statsHistoryElements+5))
+}
+
+func TestStatsBlockedPercentage(t *testing.T) {
+	s := newStats()
+	now := time.Now()
+	blocked := &logEntry{Time: now, Result: dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList}}
+
+	// current hour: 1 of 4 requests is blocked
+	s.incrementCounters(blocked)
+	for i := 0; i < 3; i++ {
+		s.incrementCounters(&logEntry{Time: now})
+	}
+	// previous hour: both requests are blocked
+	blocked = &logEntry{Time: now.Add(-time.Hour), Result: dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredSafeBrowsing}}
+	s.incrementCounters(blocked)
+	s.incrementCounters(blocked)
+
+	m := s.generateMapFromStats(&s.perHour, 0, 2)
+	assert.Equal(t, []float64{0, 100, 25}, m["blocked_percentage"])
+
+	assert.Equal(t, 50.0, s.getAggregatedStats().BlockedPercentage)
+}
+
+func TestStatsTotalBlocked(t *testing.T) {
+	s := newStats()
+	now := time.Now()
+	for i := 0; i < 30; i++ {
+		entry := &logEntry{Time: now.Add(-time.Duration(i) * time.Hour)}
+		if i%3 == 0 {
+			entry.Result = dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList}
+		}
+		s.incrementCounters(entry)
+	}
+	entry := &logEntry{Time: now, Result: dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredSafeBrowsing}}
+	s.incrementCounters(entry)
+
+	assert.Equal(t, uint64(9), s.getTotalBlocked())
+	assert.Equal(t, float64(s.getTotalBlocked()), s.getAggregatedStats().BlockedFiltering)
+}
+
+func TestStatsMovingAverage(t *testing.T) {
+	series := []float64{2, 4, 6, 8, 10}
+	assert.Equal(t, []float64{2, 3, 4, 6, 8}, movingAverage(series, 3))
+	assert.Equal(t, []float64{2, 3, 4, 5, 6}, movingAverage(series, 10))
+	assert.Equal(t, series, movingAverage(series, 0))
+	assert.Equal(t, series, movingAverage(series, -1))
+	assert.Equal(t, series, movingAverage(series, 1))
+
+	s := newStats()
+	s.perHour.Inc(s.requests.name, time.Now())
+	s.perHour.Inc(s.requests.name, time.Now())
+	avg := s.getMovingAverage(2)
+	assert.Equal(t, 24, len(avg))
+	assert.Equal(t, 1.0, avg[23])
+}
+
+func TestStatsQueriesPerClient(t *testing.T) {
+	assert.Equal(t, 2.5, queriesPerClient(10, 4))
+	assert.Equal(t, 0.0, queriesPerClient(10, 0))
+	assert.Equal(t, 0.0, queriesPerClient(0, 0))
+}
+
+func TestStatsAvgProcessingTime(t *testing.T) {
+	s := newStats()
+	now := time.Now()
+
+	// one slow request in the current hour and nine fast ones in the previous hour
+	s.incrementCounters(&logEntry{Time: now, Elapsed: 100 * time.Millisecond})
+	for i := 0; i < 9; i++ {
+		s.incrementCounters(&logEntry{Time: now.Add(-time.Hour), Elapsed: 10 * time.Millisecond})
+	}
+
+	// weighted: (100 + 9*10) / 10 = 19ms; the mean of the hourly means would be (100 + 10) / 2 = 55ms
+	assert.InDelta(t, 19.0, s.getAggregatedStats().AvgProcessingTime, 0.0001)
+
+	assert.Equal(t, 0.0, newStats().getAggregatedStats().AvgProcessingTime)
+}
+
+func TestStatsAvgProcessingTimeSeries(t *testing.T) {
+	s := newStats()
+	now := time.Now()
+
+	s.incrementCounters(&logEntry{Time: now, Elapsed: 10 * time.Millisecond})
+	s.incrementCounters(&logEntry{Time: now, Elapsed: 30 * time.Millisecond})
+	s.incrementCounters(&logEntry{Time: now.Add(-2 * time.Hour), Elapsed: 5 * time.Millisecond})
+
+	m := s.generateMapFromStats(&s.perHour, 0, 2)
+	series := m["avg_processing_time"].([]float64)
+	assert.Equal(t, 3, len(series))
+	assert.InDelta(t, 5.0, series[0], 0.0001)
+	assert.Equal(t, 0.0, series[1])
+	assert.InDelta(t, 20.0, series[2], 0.0001)
+}
+
+func TestStatsToday(t *testing.T) {
+	s := newStats()
+	now := time.Now()
+	for i := 0; i < 30; i++ {
+		s.perHour.Inc(s.requests.name, now.Add(-time.Duration(i)*time.Hour))
+	}
+
+	// pick a time zone in which it's 05:30 now
+	sinceMidnight := now.UTC().Sub(now.UTC().Truncate(24 * time.Hour))
+	offset := 5*time.Hour + 30*time.Minute - sinceMidnight
+	loc := time.FixedZone("test", int(offset.Seconds()))
+	assert.Equal(t, 5, now.In(loc).Hour())
+
+	today := s.getStatsToday(now, loc)
+	assert.Equal(t, 6.0, today.DNSQueries)
+	assert.Equal(t, "today", today.StatsPeriod)
+}
+
+func TestStatsResultReasons(t *testing.T) {
+	s := newStats()
+	numReasons := 0
+	for reason := dnsfilter.Reason(0); reason.String() != ""; reason++ {
+		// each reason N is counted N+1 times
+		for i := 0; i <= int(reason); i++ {
+			s.incrementCounters(&logEntry{Time: time.Now(), Result: dnsfilter.Result{Reason: reason}})
+		}
+		numReasons++
+	}
+	assert.True(t, numReasons > int(dnsfilter.ReasonRewrite))
+
+	reasons := s.getAggregatedStats().ResultReasons
+	assert.Equal(t, numReasons, len(reasons))
+	for i, r := range reasons {
+		assert.Equal(t, i, r.ID)
+		assert.Equal(t, dnsfilter.Reason(i).String(), r.Name)
+		assert.Equal(t, float64(i+1), r.Count)
+	}
+}
+
+func TestStatsOldestTimestamp(t *testing.T) {
+	s := newStats()
+	assert.Equal(t, "", s.getAggregatedStats().OldestDataTime)
+
+	lastRotate := s.perHour.lastRotate
+	s.perHour.Inc(s.requests.name, lastRotate)
+	s.perHour.Inc(s.requests.name, lastRotate.Add(-5*time.Hour-time.Minute))
+	s.perHour.Inc(s.requests.name, lastRotate.Add(-30*time.Hour))
+
+	// the beginning of the hourly period with the oldest request
+	requests := s.perHour.snapshot()[s.requests.name]
+	oldest, ok := oldestTimestamp(requests, 23, lastRotate)
+	assert.True(t, ok)
+	assert.Equal(t, lastRotate.Add(-6*time.Hour), oldest)
+
+	oldest, ok = oldestTimestamp(requests, statsHistoryElements-1, lastRotate)
+	assert.True(t, ok)
+	assert.Equal(t, lastRotate.Add(-30*time.Hour), oldest)
+
+	assert.NotEqual(t, "", s.getAggregatedStats().OldestDataTime)
+}
+
+func TestStatsIncrementWhilePurging(t *testing.T) {
+	s := newStats()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			s.incrementCounters(&logEntry{Time: time.Now(), Elapsed: time.Millisecond})
+		}
+		close(done)
+	}()
+
+	for i := 0; i < 100; i++ {
+		s.purgeStats()
+	}
+	<-done
+
+	s.purgeStats()
+	s.incrementCounters(&logEntry{Time: time.Now()})
+	assert.Equal(t, 1.0, s.getAggregatedStats().DNSQueries)
+}
+
+func TestStatsTransports(t *testing.T) {
+	s := newStats()
+	for _, proto := range []string{"udp", "udp", "tcp", "https", "quic", ""} {
+		s.incrementCounters(&logEntry{Time: time.Now(), Proto: proto})
+	}
+
+	m := s.getAggregatedStats()
+	assert.Equal(t, map[string]float64{"udp": 2, "tcp": 1, "tls": 0, "https": 1}, m.QueryTransports)
+	assert.Equal(t, 6.0, m.DNSQueries)
+}
+
+func TestStatsProcessingTimeHistogram(t *testing.T) {
+	s := newStats()
+	for _, elapsed := range []time.Duration{
+		500 * time.Microsecond,
+		time.Millisecond, 5 * time.Millisecond, 9 * time.Millisecond,
+		50 * time.Millisecond,
+		100 * time.Millisecond, time.Second,
+	} {
+		s.incrementCounters(&logEntry{Time: time.Now(), Elapsed: elapsed})
+	}
+
+	histogram := s.getAggregatedStats().ProcessingTimeHistogram
+	assert.Equal(t, len(processingTimeBounds)+1, len(histogram))
+	assert.Equal(t, []HistogramBucket{
+		{UpperBoundMs: 1, Count: 1},
+		{UpperBoundMs: 2, Count: 1},
+		{UpperBoundMs: 5, Count: 0},
+		{UpperBoundMs: 10, Count: 2},
+		{UpperBoundMs: 20, Count: 0},
+		{UpperBoundMs: 50, Count: 0},
+		{UpperBoundMs: 100, Count: 1},
+		{UpperBoundMs: 200, Count: 1},
+		{UpperBoundMs: 500, Count: 0},
+		{UpperBoundMs: 1000, Count: 0},
+		{Count: 1},
+	}, histogram)
+}
+
+func TestStatsLatencyPercentiles(t *testing.T) {
+	s := newStats()
+	add := func(n int, elapsed time.Duration) {
+		for i := 0; i < n; i++ {
+			s.incrementCounters(&logEntry{Time: time.Now(), Elapsed: elapsed})
+		}
+	}
+	add(50, 500*time.Microsecond)
+	add(45, 15*time.Millisecond)
+	add(5, 300*time.Millisecond)
+
+	m := s.getAggregatedStats()
+	assert.InDelta(t, 1.0, m.LatencyP50, 0.001)
+	assert.InDelta(t, 20.0, m.LatencyP95, 0.001)
+	assert.InDelta(t, 440.0, m.LatencyP99, 0.001)
+
+	// values above the last bound are estimated as the last bound
+	add(100, 5*time.Second)
+	assert.InDelta(t, 1000.0, s.getAggregatedStats().LatencyP99, 0.001)
+
+	assert.Equal(t, 0.0, histogramPercentile([]float64{1, 10}, []float64{0, 0, 0}, 0.5))
+}
+
+func TestStatsForecast(t *testing.T) {
+	// a clean daily pattern and a partial current hour
+	requests := [statsHistoryElements]float64{}
+	requests[0] = 100
+	for i := 1; i < statsHistoryElements; i++ {
+		requests[i] = float64(i%24+1) * 10
+	}
+
+	assert.Equal(t, []float64{240, 230, 220, 210, 200, 190}, forecast(requests, 6))
+	predicted := forecast(requests, 100)
+	assert.Equal(t, forecastMaxHorizon, len(predicted))
+	for h := 1; h <= forecastMaxHorizon; h++ {
+		assert.Equal(t, requests[48-h], predicted[h-1])
+	}
+	assert.Equal(t, []float64{}, forecast(requests, 0))
+
+	// the same hours of the previous days are averaged
+	requests[23] = 0
+	assert.Equal(t, []float64{120}, forecast(requests, 1))
+
+	// less than a day of history: the hour 24 hours ago is missing
+	short := [statsHistoryElements]float64{}
+	copy(short[:24], requests[:24])
+	short[23] = 240
+	predicted = forecast(short, 24)
+	assert.Equal(t, 23, len(predicted))
+	assert.Equal(t, 240.0, predicted[0])
+
+	// not enough history for the next hour
+	short[23] = 0
+	assert.Equal(t, []float64{}, forecast(short, 24))
+	assert.Equal(t, []float64{}, newStats().getForecast(24))
+}
+
+func TestStatsHourlyDailyHistory(t *testing.T) {
+	s := newStats()
+	hourRotate := s.perHour.lastRotate
+	dayRotate := s.perDay.lastRotate
+	for i := 0; i < 30; i++ {
+		s.perHour.Inc(s.requests.name, hourRotate.Add(-time.Duration(i)*time.Hour))
+		s.perDay.Inc(s.requests.name, dayRotate.Add(-time.Duration(i)*24*time.Hour))
+		s.perDay.Inc(s.filtered.name, dayRotate.Add(-time.Duration(i)*24*time.Hour))
+	}
+
+	m := s.getHourlyDailyHistory(24, 7)
+	hourly := m["hourly"].(map[string]interface{})
+	daily := m["daily"].(map[string]interface{})
+	assert.Equal(t, 24, len(hourly["dns_queries"].([]float64)))
+	assert.Equal(t, 7, len(daily["dns_queries"].([]float64)))
+
+	// the same as the single time unit calls
+	single, err := s.getStatsHistory(time.Hour, hourRotate.Add(-23*time.Hour), hourRotate)
+	assert.Nil(t, err)
+	assert.Equal(t, single, hourly)
+	single, err = s.getStatsHistory(24*time.Hour, dayRotate.Add(-6*24*time.Hour), dayRotate)
+	assert.Nil(t, err)
+	assert.Equal(t, single, daily)
+}
+
+func TestStatsTable(t *testing.T) {
+	s := newStats()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		when := now.Add(-time.Duration(i) * time.Hour)
+		for j := 0; j <= i; j++ {
+			s.incrementCounters(&logEntry{Time: when, Elapsed: time.Duration(i+1) * time.Millisecond})
+		}
+		s.incrementCounters(&logEntry{Time: when, Result: dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredSafeBrowsing}})
+		s.incrementCounters(&logEntry{Time: when, Result: dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredParental}})
+	}
+
+	rows, err := s.getTable(time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, statsHistoryElements, len(rows))
+
+	// the rows line up with the series
+	m := s.generateMapFromStats(&s.perHour, 0, statsHistoryElements-1)
+	labels := timeLabels(s.perHour.lastRotate, time.Hour, 0, statsHistoryElements-1)
+	for i, row := range rows {
+		assert.Equal(t, labels[i], row.Time)
+		assert.Equal(t, m["dns_queries"].([]float64)[i], row.Total)
+		assert.Equal(t, m["blocked_filtering"].([]float64)[i], row.Blocked)
+		assert.Equal(t, m["replaced_safebrowsing"].([]float64)[i], row.Safebrowsing)
+		assert.Equal(t, m["replaced_parental"].([]float64)[i], row.Parental)
+		assert.Equal(t, m["avg_processing_time"].([]float64)[i], row.AvgTime)
+	}
+	newest := rows[len(rows)-1]
+	assert.InDelta(t, 1.0/3, newest.AvgTime, 0.0001)
+	newest.AvgTime = 0
+	assert.Equal(t, StatsRow{Time: labels[len(labels)-1], Total: 3, Blocked: 2, Safebrowsing: 1, Parental: 1}, newest)
+
+	_, err = s.getTable(time.Millisecond)
+	assert.NotNil(t, err)
+}
+
+func TestStatsSnapshot(t *testing.T) {
+	s := newStats()
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		s.perSecond.Inc(s.requests.name, s.perSecond.lastRotate.Add(-time.Second))
+	}
+	s.perSecond.Inc(s.requests.name, s.perSecond.lastRotate) // the current second isn't counted
+	s.perHour.Inc(s.requests.name, now)
+	s.perHour.Inc(s.filtered.name, now)
+
+	snapshot := s.getSnapshot(now)
+	assert.Equal(t, now, snapshot.Time)
+	assert.Equal(t, 1.0, snapshot.DNSQueries)
+	assert.Equal(t, 1.0, snapshot.BlockedFiltering)
+	assert.Equal(t, 2.0, snapshot.QueriesPerSecond)
+}
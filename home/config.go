@@ -110,6 +110,9 @@ type dnsConfig struct {
 	dnsforward.FilteringConfig `yaml:",inline"`
 
 	UpstreamDNS []string `yaml:"upstream_dns"`
+
+	// QueryExportFile is the file the logged DNS requests are appended to as JSON lines, empty to disable
+	QueryExportFile string `yaml:"query_export_file"`
 }
 
 var defaultDNS = []string{
@@ -2,17 +2,18 @@ package home
 
 import (
 	"bytes"
+	"container/heap"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
@@ -129,6 +130,9 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		"version":            versionString,
 		"language":           config.Language,
 	}
+	if config.dnsServer != nil {
+		data["top_memory_estimate"] = config.dnsServer.TopMemEstimate()
+	}
 
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
@@ -189,21 +193,60 @@ func handleQueryLog(w http.ResponseWriter, r *http.Request) {
 
 func handleStatsTop(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
-	s := config.dnsServer.GetStatsTop()
+	q := r.URL.Query()
+	if q.Get("hour") != "" && q.Get("reason") != "" {
+		httpError(w, http.StatusBadRequest, "hour and reason parameters can't be used together")
+		return
+	}
+
+	var s *dnsforward.StatsTop
+	period := "24 hours"
+	firstHour, lastHour := 0, 23
+	if q.Get("hour") != "" {
+		hour, err := strconv.Atoi(q.Get("hour"))
+		if err == nil {
+			s, err = config.dnsServer.GetStatsTopForHour(hour)
+		}
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Invalid hour parameter: %s", err)
+			return
+		}
+		period = "1 hour"
+		firstHour, lastHour = hour, hour
+	} else {
+		s = config.dnsServer.GetStatsTop()
+	}
+
+	s = config.dnsServer.GroupStatsTop(s)
+
+	blocked := s.Blocked
+	if name := q.Get("reason"); name != "" {
+		reason, ok := parseReason(name)
+		if !ok {
+			httpError(w, http.StatusBadRequest, "Unknown reason: %s", name)
+			return
+		}
+		blocked = config.dnsServer.GetTopBlockedByReason(reason)
+	}
+
+	byTime := false
+	switch q.Get("sort") {
+	case "", "count":
+	case "time":
+		byTime = true
+	default:
+		httpError(w, http.StatusBadRequest, "Unknown sort order: %s", q.Get("sort"))
+		return
+	}
 
 	// use manual json marshalling because we want maps to be sorted by value
 	statsJSON := bytes.Buffer{}
 	statsJSON.WriteString("{\n")
 
-	gen := func(json *bytes.Buffer, name string, top map[string]int, addComma bool) {
+	gen := func(json *bytes.Buffer, name string, top map[string]int, sorted []string, addComma bool) {
 		json.WriteString("  ")
 		json.WriteString(fmt.Sprintf("%q", name))
 		json.WriteString(": {\n")
-		sorted := sortByValue(top)
-		// no more than 50 entries
-		if len(sorted) > 50 {
-			sorted = sorted[:50]
-		}
 		for i, key := range sorted {
 			json.WriteString("    ")
 			json.WriteString(fmt.Sprintf("%q", key))
@@ -220,19 +263,237 @@ func handleStatsTop(w http.ResponseWriter, r *http.Request) {
 		}
 		json.WriteByte('\n')
 	}
-	gen(&statsJSON, "top_queried_domains", s.Domains, true)
-	gen(&statsJSON, "top_blocked_domains", s.Blocked, true)
-	gen(&statsJSON, "top_clients", s.Clients, true)
-	statsJSON.WriteString("  \"stats_period\": \"24 hours\"\n")
+	// no more than 50 entries
+	gen(&statsJSON, "top_queried_domains", s.Domains, topByValue(s.Domains, 50), true)
+	gen(&statsJSON, "top_blocked_domains", blocked, topByValue(blocked, 50), true)
+	clients := topClientsOrder(s, byTime, 50)
+	gen(&statsJSON, "top_clients", s.Clients, clients, true)
+	gen(&statsJSON, "top_clients_time", s.ClientsTime, clients, true)
+	seen, err := json.Marshal(config.dnsServer.GetClientsSeen(clients))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal top clients: %s", err)
+		return
+	}
+	statsJSON.WriteString("  \"top_clients_seen\": ")
+	statsJSON.Write(seen)
+	statsJSON.WriteString(",\n")
+	lists := filterNames(s.Lists)
+	gen(&statsJSON, "top_blocklists", lists, topByValue(lists, 50), true)
+
+	detailed, err := json.Marshal(s.DetailedDomains(50))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal top domains: %s", err)
+		return
+	}
+	statsJSON.WriteString("  \"top_domains_detailed\": ")
+	statsJSON.Write(detailed)
+	statsJSON.WriteString(",\n")
+
+	detailed, err = json.Marshal(s.DetailedClients(50))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal top clients: %s", err)
+		return
+	}
+	statsJSON.WriteString("  \"top_clients_detailed\": ")
+	statsJSON.Write(detailed)
+	statsJSON.WriteString(",\n")
+	total := config.dnsServer.GetTotalQueries(firstHour, lastHour)
+	statsJSON.WriteString(fmt.Sprintf("  \"top_domains_coverage\": %v,\n", topCoverage(s.Domains, 50, total)))
+	statsJSON.WriteString(fmt.Sprintf("  \"top_clients_coverage\": %v,\n", topCoverage(s.Clients, 50, total)))
+	statsJSON.WriteString(fmt.Sprintf("  \"top_queried_domains_other\": %d,\n", topOther(s.Domains, topByValue(s.Domains, 50), total)))
+	statsJSON.WriteString(fmt.Sprintf("  \"top_clients_other\": %d,\n", topOther(s.Clients, clients, total)))
+	statsJSON.WriteString(fmt.Sprintf("  \"stats_period\": %q\n", period))
 	statsJSON.WriteString("}\n")
 
 	w.Header().Set("Content-Type", "application/json")
-	_, err := w.Write(statsJSON.Bytes())
+	_, err = w.Write(statsJSON.Bytes())
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "Couldn't write body: %s", err)
 	}
 }
 
+// topClientsOrder returns up to n top clients ordered by the number of requests
+// or, if byTime is true, by the summed processing time of their requests
+func topClientsOrder(s *dnsforward.StatsTop, byTime bool, n int) []string {
+	if byTime {
+		return topByValue(s.ClientsTime, n)
+	}
+	return topByValue(s.Clients, n)
+}
+
+// topCoverage returns the share of all the requests counted by the first n entries of the top list
+// the top lists don't count every request, so the result is between 0 and 1
+func topCoverage(top map[string]int, n int, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	coverage := float64(topSum(top, topByValue(top, n))) / float64(total)
+	if coverage > 1 {
+		coverage = 1
+	}
+	return coverage
+}
+
+// topOther returns the number of requests not counted by the specified entries of the top list,
+// so that these entries and the result add up to total
+func topOther(top map[string]int, keys []string, total uint64) uint64 {
+	sum := topSum(top, keys)
+	if sum > total {
+		return 0
+	}
+	return total - sum
+}
+
+// topSum returns the number of requests counted by the specified entries of the top list
+func topSum(top map[string]int, keys []string) uint64 {
+	sum := uint64(0)
+	for _, key := range keys {
+		sum += uint64(top[key])
+	}
+	return sum
+}
+
+// filterNames replaces filter list IDs with filter list names
+// the user rules and unknown (e.g. removed) lists keep their IDs
+func filterNames(lists map[string]int) map[string]int {
+	config.RLock()
+	defer config.RUnlock()
+
+	names := map[string]string{}
+	used := map[string]int{}
+	for _, f := range config.Filters {
+		name := f.Name
+		if name == "" {
+			name = f.URL
+		}
+		names[strconv.FormatInt(f.ID, 10)] = name
+		used[name]++
+	}
+	// lists with the same name are told apart by their IDs
+	for id, name := range names {
+		if used[name] > 1 {
+			names[id] = fmt.Sprintf("%s (%s)", name, id)
+		}
+	}
+
+	result := map[string]int{}
+	for id, count := range lists {
+		name, ok := names[id]
+		if !ok {
+			name = id
+		}
+		result[name] += count
+	}
+	return result
+}
+
+// parseReason returns the filtering reason with the specified name
+func parseReason(name string) (dnsfilter.Reason, bool) {
+	for _, reason := range dnsfilter.Reasons {
+		if reason.String() == name {
+			return reason, true
+		}
+	}
+	return 0, false
+}
+
+// handleStatsClientDomains returns the top domains requested by a single client
+func handleStatsClientDomains(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	q := r.URL.Query()
+	ip := q.Get("ip")
+	if ip == "" {
+		httpError(w, http.StatusBadRequest, "ip parameter is required")
+		return
+	}
+	n := 50
+	if q.Get("n") != "" {
+		var err error
+		n, err = strconv.Atoi(q.Get("n"))
+		if err != nil || n <= 0 {
+			httpError(w, http.StatusBadRequest, "Invalid n parameter: %s", q.Get("n"))
+			return
+		}
+	}
+
+	top := config.dnsServer.GetTopDomainsForClient(ip)
+	data := []map[string]interface{}{}
+	for _, domain := range topByValue(top, n) {
+		data = append(data, map[string]interface{}{
+			"name":  domain,
+			"count": top[domain],
+		})
+	}
+	statsJSON, err := json.Marshal(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal status json: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(statsJSON)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to write response json: %s", err)
+		return
+	}
+}
+
+// handleStatsDomain returns the number of allowed and blocked queries for a single domain
+func handleStatsDomain(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		httpError(w, http.StatusBadRequest, "domain parameter is required")
+		return
+	}
+
+	allowed, blocked := config.dnsServer.GetDomainCount(domain)
+	data := map[string]interface{}{
+		"domain":  domain,
+		"allowed": allowed,
+		"blocked": blocked,
+	}
+	statsJSON, err := json.Marshal(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal status json: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(statsJSON)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to write response json: %s", err)
+		return
+	}
+}
+
+// handleStatsForecast returns the expected number of requests for the next hours
+func handleStatsForecast(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	horizon := 24
+	if q := r.URL.Query().Get("horizon"); q != "" {
+		var err error
+		horizon, err = strconv.Atoi(q)
+		if err != nil || horizon < 1 || horizon > 24 {
+			httpError(w, http.StatusBadRequest, "horizon must be a number of hours from 1 to 24")
+			return
+		}
+	}
+
+	data := map[string]interface{}{
+		"dns_queries": config.dnsServer.Forecast(horizon),
+	}
+	statsJSON, err := json.Marshal(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal status json: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(statsJSON)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to write response json: %s", err)
+		return
+	}
+}
+
 // handleStatsReset resets the stats caches
 func handleStatsReset(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
@@ -243,10 +504,47 @@ func handleStatsReset(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleStatsTopReset clears the top lists, the other stats are kept
+func handleStatsTopReset(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	config.dnsServer.ClearTopLists()
+	_, err := fmt.Fprintf(w, "OK\n")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write body: %s", err)
+	}
+}
+
+// handleStatsFlush writes the buffered query log entries (stats are restored from them) to disk
+func handleStatsFlush(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	err := config.dnsServer.FlushQueryLog()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't flush query log: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
 // handleStats returns aggregated stats data for the 24 hours
 func handleStats(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
-	summed := config.dnsServer.GetAggregatedStats()
+	statsJSON, err := config.dnsServer.GetAggregatedStatsJSON()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal status json: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(statsJSON)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to write response json: %s", err)
+		return
+	}
+}
+
+// handleStatsToday returns stats data aggregated since the local midnight
+func handleStatsToday(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	summed := config.dnsServer.GetStatsToday(time.Local)
 
 	statsJSON, err := json.Marshal(summed)
 	if err != nil {
@@ -313,23 +611,97 @@ func handleStatsHistory(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// sortByValue is a helper function for querylog API
-func sortByValue(m map[string]int) []string {
-	type kv struct {
-		k string
-		v int
+// handleStatsHistoryHourlyDaily returns historical stats data for the last hours and days in one response
+func handleStatsHistoryHourlyDaily(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	numHours, ok := parseNumPeriods(r.URL.Query().Get("hours"), 24)
+	if !ok {
+		httpError(w, http.StatusBadRequest, "hours must be a number from 1 to 61")
+		return
+	}
+	numDays, ok := parseNumPeriods(r.URL.Query().Get("days"), 30)
+	if !ok {
+		httpError(w, http.StatusBadRequest, "days must be a number from 1 to 61")
+		return
 	}
-	var ss []kv
+
+	data := config.dnsServer.GetHourlyDailyHistory(numHours, numDays)
+	statsJSON, err := json.Marshal(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal status json: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(statsJSON)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to write response json: %s", err)
+		return
+	}
+}
+
+// parseNumPeriods parses the number of stats periods, 1 to 61, def is returned for an empty string
+func parseNumPeriods(s string, def int) (int, bool) {
+	if s == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > 61 {
+		return 0, false
+	}
+	return n, true
+}
+
+type countPair struct {
+	key   string
+	count int
+}
+
+// before returns true if a goes before b in a top list: higher counts first, ties are ordered by key
+func (a countPair) before(b countPair) bool {
+	if a.count != b.count {
+		return a.count > b.count
+	}
+	return a.key < b.key
+}
+
+// countPairHeap is a min-heap with the pair that goes last in a top list on top
+type countPairHeap []countPair
+
+func (h countPairHeap) Len() int            { return len(h) }
+func (h countPairHeap) Less(i, j int) bool  { return h[j].before(h[i]) }
+func (h countPairHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *countPairHeap) Push(x interface{}) { *h = append(*h, x.(countPair)) }
+func (h *countPairHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// topByValue returns up to n keys with the highest values, sorted by value
+// it runs in O(len(m) * log(n)) and doesn't sort the whole map
+func topByValue(m map[string]int, n int) []string {
+	if n > len(m) {
+		n = len(m)
+	}
+	if n <= 0 {
+		return []string{}
+	}
+
+	h := make(countPairHeap, 0, n)
 	for k, v := range m {
-		ss = append(ss, kv{k, v})
+		p := countPair{key: k, count: v}
+		if len(h) < n {
+			heap.Push(&h, p)
+		} else if p.before(h[0]) {
+			h[0] = p
+			heap.Fix(&h, 0)
+		}
 	}
-	sort.Slice(ss, func(l, r int) bool {
-		return ss[l].v > ss[r].v
-	})
 
-	sorted := []string{}
-	for _, v := range ss {
-		sorted = append(sorted, v.k)
+	sorted := make([]string, len(h))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(&h).(countPair).key
 	}
 	return sorted
 }
@@ -985,10 +1357,17 @@ func registerControlHandlers() {
 	http.HandleFunc("/control/test_upstream_dns", postInstall(optionalAuth(ensurePOST(handleTestUpstreamDNS))))
 	http.HandleFunc("/control/i18n/change_language", postInstall(optionalAuth(ensurePOST(handleI18nChangeLanguage))))
 	http.HandleFunc("/control/i18n/current_language", postInstall(optionalAuth(ensureGET(handleI18nCurrentLanguage))))
-	http.HandleFunc("/control/stats_top", postInstall(optionalAuth(ensureGET(handleStatsTop))))
-	http.HandleFunc("/control/stats", postInstall(optionalAuth(ensureGET(handleStats))))
-	http.HandleFunc("/control/stats_history", postInstall(optionalAuth(ensureGET(handleStatsHistory))))
+	http.Handle("/control/stats_top", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleStatsTop)))))
+	http.Handle("/control/stats", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleStats)))))
+	http.Handle("/control/stats_history", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleStatsHistory)))))
+	http.Handle("/control/stats_history_hourly_daily", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleStatsHistoryHourlyDaily)))))
+	http.Handle("/control/stats_client_domains", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleStatsClientDomains)))))
+	http.Handle("/control/stats_domain", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleStatsDomain)))))
+	http.Handle("/control/stats_today", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleStatsToday)))))
+	http.Handle("/control/stats_forecast", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleStatsForecast)))))
 	http.HandleFunc("/control/stats_reset", postInstall(optionalAuth(ensurePOST(handleStatsReset))))
+	http.HandleFunc("/control/stats_top_reset", postInstall(optionalAuth(ensurePOST(handleStatsTopReset))))
+	http.HandleFunc("/control/stats_flush", postInstall(optionalAuth(ensurePOST(handleStatsFlush))))
 	http.HandleFunc("/control/version.json", postInstall(optionalAuth(handleGetVersionJSON)))
 	http.HandleFunc("/control/update", postInstall(optionalAuth(ensurePOST(handleUpdate))))
 	http.HandleFunc("/control/filtering/enable", postInstall(optionalAuth(ensurePOST(handleFilteringEnable))))
@@ -1,8 +1,22 @@
 package home
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/NYTimes/gziphandler"
 )
 
 /* Tests performed:
@@ -151,3 +165,188 @@ func TestValidateUpstreamsSet(t *testing.T) {
 		t.Fatalf("there is an invalid upstream in set, but it pass through validation")
 	}
 }
+
+func TestTopByValue(t *testing.T) {
+	m := map[string]int{"a": 1, "b": 5, "c": 3, "d": 5, "e": 0}
+	top := topByValue(m, 3)
+	if strings.Join(top, ",") != "b,d,c" {
+		t.Fatalf("topByValue(): %v", top)
+	}
+
+	top = topByValue(m, 100)
+	if strings.Join(top, ",") != "b,d,c,a,e" {
+		t.Fatalf("topByValue(): %v", top)
+	}
+
+	if len(topByValue(m, 0)) != 0 || len(topByValue(nil, 10)) != 0 {
+		t.Fatalf("topByValue() must return an empty list")
+	}
+}
+
+func TestTopClientsOrder(t *testing.T) {
+	top := &dnsforward.StatsTop{
+		Clients:     map[string]int{"1.2.3.4": 5, "5.6.7.8": 2, "9.9.9.9": 3},
+		ClientsTime: map[string]int{"1.2.3.4": 5000, "5.6.7.8": 150000, "9.9.9.9": 30000},
+	}
+
+	byCount := topClientsOrder(top, false, 50)
+	if !reflect.DeepEqual(byCount, []string{"1.2.3.4", "9.9.9.9", "5.6.7.8"}) {
+		t.Fatalf("topClientsOrder() by count: %v", byCount)
+	}
+	byTime := topClientsOrder(top, true, 50)
+	if !reflect.DeepEqual(byTime, []string{"5.6.7.8", "9.9.9.9", "1.2.3.4"}) {
+		t.Fatalf("topClientsOrder() by time: %v", byTime)
+	}
+	byTime = topClientsOrder(top, true, 1)
+	if !reflect.DeepEqual(byTime, []string{"5.6.7.8"}) {
+		t.Fatalf("topClientsOrder() by time: %v", byTime)
+	}
+}
+
+func TestTopCoverage(t *testing.T) {
+	m := map[string]int{"a": 1, "b": 5, "c": 3, "d": 1}
+	if c := topCoverage(m, 50, 10); c != 1 {
+		t.Fatalf("topCoverage(): %v", c)
+	}
+	if c := topCoverage(m, 2, 10); c != 0.8 {
+		t.Fatalf("topCoverage(): %v", c)
+	}
+	if c := topCoverage(m, 50, 20); c != 0.5 {
+		t.Fatalf("topCoverage(): %v", c)
+	}
+	// the counters can't be more than the total, but keep the result in range anyway
+	if c := topCoverage(m, 50, 5); c != 1 {
+		t.Fatalf("topCoverage(): %v", c)
+	}
+	if c := topCoverage(m, 50, 0); c != 0 {
+		t.Fatalf("topCoverage(): %v", c)
+	}
+}
+
+func TestTopOther(t *testing.T) {
+	m := map[string]int{"a": 1, "b": 5, "c": 3, "d": 1}
+	for _, n := range []int{1, 2, 4, 50} {
+		var total uint64 = 25
+		keys := topByValue(m, n)
+		other := topOther(m, keys, total)
+		sum := 0
+		for _, key := range keys {
+			sum += m[key]
+		}
+		if uint64(sum)+other != total {
+			t.Fatalf("topOther(%d): %d + %d != %d", n, sum, other, total)
+		}
+	}
+	// the counters can't be more than the total, but keep the result in range anyway
+	if o := topOther(m, topByValue(m, 50), 5); o != 0 {
+		t.Fatalf("topOther(): %d", o)
+	}
+}
+
+func TestStatsGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats_gzip")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dnsServer := config.dnsServer
+	config.dnsServer = dnsforward.NewServer(dir)
+	defer func() {
+		config.dnsServer.Close()
+		config.dnsServer = dnsServer
+	}()
+
+	get := func(h http.Handler, url string, acceptGzip bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		if acceptGzip {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// the same handlers chain as the stats endpoints, without the authentication
+	h := gziphandler.GzipHandler(ensureGETHandler(handleStatsHistoryHourlyDaily))
+	url := "/control/stats_history_hourly_daily?hours=61&days=61"
+	plain := get(h, url, false)
+	if enc := plain.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("Content-Encoding without Accept-Encoding: %q", enc)
+	}
+	if plain.Body.Len() <= gziphandler.DefaultMinSize {
+		t.Fatalf("the response is too small to be compressed: %d bytes", plain.Body.Len())
+	}
+
+	compressed := get(h, url, true)
+	if enc := compressed.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding: %q", enc)
+	}
+	zr, err := gzip.NewReader(compressed.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader(): %s", err)
+	}
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompressing the response: %s", err)
+	}
+	if !bytes.Equal(body, plain.Body.Bytes()) {
+		t.Fatalf("the decompressed response differs:\n%s\n%s", body, plain.Body.Bytes())
+	}
+
+	// small responses aren't compressed
+	small := get(gziphandler.GzipHandler(ensureGETHandler(handleStatsForecast)), "/control/stats_forecast", true)
+	if enc := small.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("Content-Encoding of a small response: %q", enc)
+	}
+	if small.Body.String() != `{"dns_queries":[]}` {
+		t.Fatalf("the small response: %s", small.Body.String())
+	}
+}
+
+func TestFilterNames(t *testing.T) {
+	filters := config.Filters
+	defer func() { config.Filters = filters }()
+
+	config.Filters = []filter{
+		{Name: "list one", Filter: dnsfilter.Filter{ID: 1}},
+		{URL: "https://example.org/list.txt", Filter: dnsfilter.Filter{ID: 2}},
+		{Name: "list one", Filter: dnsfilter.Filter{ID: 3}},
+	}
+	names := filterNames(map[string]int{"0": 1, "1": 2, "2": 3, "3": 4, "4": 5})
+	expected := map[string]int{"0": 1, "list one (1)": 2, "list one (3)": 4, "https://example.org/list.txt": 3, "4": 5}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("filterNames(): %v", names)
+	}
+}
+
+func benchmarkTopMap() map[string]int {
+	m := map[string]int{}
+	for i := 0; i < 50000; i++ {
+		m[fmt.Sprintf("host%d.example.org", i)] = (i * 7919) % 1000
+	}
+	return m
+}
+
+func BenchmarkTopByValue(b *testing.B) {
+	m := benchmarkTopMap()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = topByValue(m, 50)
+	}
+}
+
+func BenchmarkTopBySort(b *testing.B) {
+	m := benchmarkTopMap()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pairs := make([]countPair, 0, len(m))
+		for k, v := range m {
+			pairs = append(pairs, countPair{key: k, count: v})
+		}
+		sort.Slice(pairs, func(l, r int) bool {
+			return pairs[l].before(pairs[r])
+		})
+		_ = pairs[:50]
+	}
+}
@@ -105,6 +105,9 @@ func generateServerConfig() (dnsforward.ServerConfig, error) {
 	newconfig.AllServers = config.DNS.AllServers
 	newconfig.FilterHandler = applyAdditionalFiltering
 	newconfig.OnDNSRequest = onDNSRequest
+	if config.DNS.QueryExportFile != "" {
+		newconfig.OnLogEntry = queryExportSink()
+	}
 	return newconfig, nil
 }
 
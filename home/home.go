@@ -384,6 +384,9 @@ func cleanup() {
 	if err != nil {
 		log.Error("Couldn't stop DNS server: %s", err)
 	}
+	if config.dnsServer != nil {
+		config.dnsServer.Close()
+	}
 	err = stopDHCPServer()
 	if err != nil {
 		log.Error("Couldn't stop DHCP server: %s", err)
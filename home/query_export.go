@@ -0,0 +1,60 @@
+package home
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// queryExport appends the logged DNS requests to a file, one JSON object per line
+type queryExport struct {
+	path string
+	file *os.File
+	sync.Mutex
+}
+
+var queryExporter queryExport
+
+// write appends the entry to the file at path, the file is reopened if the path has changed
+func (q *queryExport) write(path string, entry dnsforward.LogEntry) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.file != nil && q.path != path {
+		q.file.Close()
+		q.file = nil
+	}
+	if q.file == nil {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		q.file = file
+		q.path = path
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = q.file.Write(append(data, '\n'))
+	return err
+}
+
+// queryExportSink returns the OnLogEntry sink that exports the requests to the configured file
+func queryExportSink() func(entry dnsforward.LogEntry) {
+	path := config.DNS.QueryExportFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(config.ourWorkingDir, path)
+	}
+	return func(entry dnsforward.LogEntry) {
+		err := queryExporter.write(path, entry)
+		if err != nil {
+			log.Debug("Couldn't export the query to %s: %s", path, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package home
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+)
+
+func TestQueryExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "query_export")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := queryExport{}
+	path := filepath.Join(dir, "queries.json")
+	entry := dnsforward.LogEntry{Time: time.Now(), Client: "1.2.3.4", Host: "example.org", QType: "A"}
+	for i := 0; i < 2; i++ {
+		if err := q.write(path, entry); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+	}
+	q.file.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	e := dnsforward.LogEntry{}
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if e.Client != "1.2.3.4" || e.Host != "example.org" || e.QType != "A" {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+}